@@ -1,196 +1,541 @@
 /*
 	This file contains the functions and RPC handlers that Peers
 	use to handle files.
-	RequestFile():
-		- Requests a file from a Peer using a RequestFileArgs RPC.
 	ServeFile():
-		- Handles RequestFileArgs RPCs from Peers and returns the requested
-		  file (if possible) to the requesting Peer using a RequestFileReply RPC.
+		- Handles RequestFileArgs RPCs from Peers and returns the size of the
+		  requested file (if possible) using a RequestFileReply RPC.
+	ServeChunk():
+		- Handles RequestChunkArgs RPCs from Peers and returns one ChunkSize
+		  block of the requested file using a RequestChunkReply RPC.
 	RegisterFile():
 		- Peers use this function to register a file in the system. This means
 		  to make the file publicly shareable with other peers.
+	UnregisterFile():
+		- Withdraws a registered file so it is no longer shared.
+	SearchForFile():
+		- Asks the Server which Peers hold a file and downloads it from all of
+		  them at once (see swarm.go).
 	saveFile():
-		- Private function that Peers use to save a file to 'disk' once obtained from
-		  another Peer.
+		- Private function that Peers use to stream a file to 'disk' chunk by
+		  chunk while it is obtained from one or more Peers, resuming an earlier
+		  partial download of the same file if there is one.
 */
 
 package main
 
 import (
 	"fmt"
-	"io/ioutil"
+	"io"
 	"os"
 	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/junvalentine/FileSharing/protocol"
 )
 
 /*
-	Requests a given file from a given Peer.
+	Handles file request RPCs (RequestFileArgs{}) from other Peers.
+	Only the size of the file is returned, the contents are
+	served by ServeChunk(). New downloads are refused once
+	the Peer is shutting down.
 */
-func (p *Peer) RequestFile(port string, id int, file string) bool {
-	requestFileArgs := RequestFileArgs{}
-	requestFileReply := RequestFileReply{}
+func (p *Peer) ServeFile(request *protocol.RequestFileArgs, reply *protocol.RequestFileReply) error {
+	reply.File = request.File
+	reply.PeerID = request.PeerID
 
-	requestFileArgs.PeerID = p.PeerID
-	requestFileArgs.File = file
-	call("Peer.ServeFile", &requestFileArgs, &requestFileReply, port)
+	if p.isClosing() {
+		reply.FileExists = false
+		reply.ErrorMessage = "Peer is shutting down\n"
+		return nil
+	}
 
-	if requestFileReply.FileExists == false {
-		fmt.Printf("Did not receive %v from Peer %v, the file does not exist\n", file, id)
-		return false
+	filePath, ok := p.lookupFile(request.File)
+	if !ok {
+		reply.FileExists = false
+		reply.ErrorMessage = "File not found on the Server\n"
+		fmt.Printf("Peer %v requested %v, but the file does not exist\n", request.PeerID, request.File)
+		return nil
+	}
+	// Refused the same way as a missing file, not to reveal it exists.
+	if !p.allows(request.File, request.CertName, request.Groups) {
+		reply.FileExists = false
+		reply.ErrorMessage = "File not found on the Server\n"
+		fmt.Printf("Peer %v (%q) is not allowed to download %v\n", request.PeerID, request.CertName, request.File)
+		return nil
+	}
+
+	info, err := os.Stat(filePath)
+	if err != nil {
+		reply.FileExists = false
+		reply.ErrorMessage = err.Error()
+		fmt.Printf("Error reading file: %v\n", err)
+		return nil
 	}
 
-	fmt.Printf("Received %v from Peer %v\n", requestFileReply.File, id)
-	save := saveFile(requestFileReply.File, requestFileReply.FileContents, p.PeerID, p.directory)
-	return save
+	reply.FileExists = true
+	reply.Size = info.Size()
+	reply.Load = p.load(request.PeerID)
+	// The download started, a shutdown waits for its first chunk too.
+	p.recordUpload(request.PeerID)
+	fmt.Printf("Serving file %v (%v bytes) to Peer %v\n", request.File, reply.Size, request.PeerID)
+	return nil
 }
 
 /*
-	Handles file request RPCs (RequestFileArgs{}) from other Peers.
+	Handles chunk request RPCs (RequestChunkArgs{}) from other Peers.
+	Reads at most ChunkSize bytes at the requested offset, so only
+	one chunk per transfer is ever held in memory.
+*/
+func (p *Peer) ServeChunk(request *protocol.RequestChunkArgs, reply *protocol.RequestChunkReply) error {
+	p.beginChunk()
+	defer p.endChunk()
+	reply.File = request.File
+	reply.Offset = request.Offset
+
+	filePath, ok := p.lookupFile(request.File)
+	if !ok || !p.allows(request.File, request.CertName, request.Groups) {
+		reply.FileExists = false
+		reply.ErrorMessage = "File not found on the Server\n"
+		return nil
+	}
+
+	f, err := os.Open(filePath)
+	if err != nil {
+		reply.FileExists = false
+		reply.ErrorMessage = err.Error()
+		fmt.Printf("Error reading file: %v\n", err)
+		return nil
+	}
+	defer f.Close()
+
+	buf := make([]byte, protocol.ChunkSize)
+	n, err := f.ReadAt(buf, request.Offset)
+	if err != nil && err != io.EOF {
+		reply.FileExists = false
+		reply.ErrorMessage = err.Error()
+		fmt.Printf("Error reading file: %v\n", err)
+		return nil
+	}
+
+	p.recordUpload(request.PeerID)
+	reply.FileExists = true
+	reply.Data = buf[:n]
+	return nil
+}
+
+/*
+	Returns the path on disk of a registered file, resolved inside
+	the directory it was published from (see sandbox.go).
 */
-// func (p *Peer) ServeFile(request *RequestFileArgs, reply *RequestFileReply) error {
-// 	for i := 0; i < p.numFiles; i++ {
-// 		if p.files[i] == request.File {
-// 			reply.FileExists = true
-// 			reply.File = p.files[i]
-// 			location := p.fileloc[i]
-// 			f, err := ioutil.ReadFile(location + request.File)
-// 			if err != nil {
-// 				fmt.Printf("Error reading file: %v\n", err)
-// 			}
-// 			data := string(f)
-// 			reply.FileContents = data
-// 			reply.PeerID = request.PeerID
-// 			fmt.Printf("Served file %v to Peer %v\n", request.File, request.PeerID)
-// 			return nil
-// 		}
-// 	}
-// 	reply.FileExists = false
-// 	reply.ErrorMessage = "File not found on the Server\n"
-// 	reply.File = request.File
-// 	reply.PeerID = request.PeerID
-// 	fmt.Printf("Peer %v requested %v, but the file does not exist\n", request.PeerID, request.File)
-// 	return nil
-// }
-func (p *Peer) ServeFile(request *RequestFileArgs, reply *RequestFileReply) error {
-    done := make(chan bool) // create a new channel
-
-    go func() { // start a new goroutine
-        defer func() { done <- true }() // ensure done is always sent on exit
-        p.mu.Lock() // acquire the lock before accessing shared data
-        defer p.mu.Unlock() // release the lock after accessing shared data
-        for i := 0; i < p.numFiles; i++ {
-            if p.files[i] == request.File {
-                reply.FileExists = true
-                reply.File = p.files[i]
-                location := p.fileloc[i]
-                f, err := ioutil.ReadFile(location + request.File)
-                if err != nil {
-                    fmt.Printf("Error reading file: %v\n", err)
-                }
-                // data := string(f)
-                reply.FileContents = f
-                reply.PeerID = request.PeerID
-                fmt.Printf("Served file %v to Peer %v\n", request.File, request.PeerID)
-                return
-            }
-        }
-        reply.FileExists = false
-        reply.ErrorMessage = "File not found on the Server\n"
-        reply.File = request.File
-        reply.PeerID = request.PeerID
-        fmt.Printf("Peer %v requested %v, but the file does not exist\n", request.PeerID, request.File)
-    }()
-
-    <-done // wait for the goroutine to send a value
-    return nil
+func (p *Peer) lookupFile(fileName string) (string, bool) {
+	p.mu.Lock()
+	f, ok := p.files[fileName]
+	p.mu.Unlock()
+	if !ok {
+		return "", false
+	}
+
+	s, err := newSandbox(f.Location)
+	if err != nil {
+		fmt.Printf("Refusing to serve %v: %v\n", fileName, err)
+		return "", false
+	}
+	filePath, err := s.openPath(fileName)
+	if err != nil {
+		fmt.Printf("Refusing to serve %v: %v\n", fileName, err)
+		return "", false
+	}
+	return filePath, true
 }
 
 /*
-	Registers a file that a Peer has on disk into the FileShare system.
+	Returns true if the Peer whose certificate is named certName,
+	in groups, may download a registered file. Checked on every
+	request, whatever the Server's search returned.
 */
-func (p *Peer) RegisterFile(fileName string, location string) error {
+func (p *Peer) allows(fileName string, certName string, groups []string) bool {
 	p.mu.Lock()
 	defer p.mu.Unlock()
+	f, ok := p.files[fileName]
+	return ok && f.Info.Allows(certName, groups)
+}
 
-	p.files[p.numFiles] = fileName
-	p.fileloc[p.numFiles] = location
-	p.numFiles = p.numFiles + 1
+/*
+	Registers a file that a Peer has on disk into the FileShare system.
+	The file's metadata (size, SHA-256 of the file and of each of its
+	chunks, modification time, MIME type) is sent along with the given
+	description and tags, so that downloaders can pick and verify
+	the right copy. The file must be inside location. With an access
+	list only the Peers and groups in it can find and download the
+	file (see protocol.FileInfo.Allows()). The file is shared
+	with Peers as soon as it is recorded locally; p.mu is not
+	held while the Server is called, which may take a while.
+*/
+func (p *Peer) RegisterFile(fileName string, location string, description string, tags []string, access []string) error {
+	s, err := newSandbox(location)
+	if err != nil {
+		return err
+	}
+	filePath, err := s.openPath(fileName)
+	if err != nil {
+		return err
+	}
+	if len(access) > 0 && protocol.TLS == nil {
+		return fmt.Errorf("restricting access to %v needs TLS, see -cert", fileName)
+	}
+	info, err := describeFile(filePath, fileName, description, tags, access)
+	if err != nil {
+		return err
+	}
+
+	shared := &sharedFile{Location: location, Info: info}
+	p.mu.Lock()
+	p.files[fileName] = shared
+	delete(p.unpublished, fileName)
+	p.savePublished()
+	p.mu.Unlock()
 
-	request := PeerSendFile{}
-	reply := ServerReceiveFile{}
+	request := protocol.PeerSendFile{}
+	reply := protocol.ServerReceiveFile{}
 	request.FileName = fileName
-	request.PeerID = p.PeerID
+	request.PeerID = p.peerID()
+	request.Info = info
 	// request.location = location
 
-	serverCall("Server.Register", &request, &reply)
+	if err := p.serverCall(protocol.ServerRegister, &request, &reply); err != nil {
+		return err
+	}
+	if !reply.Accepted {
+		return fmt.Errorf("the server did not accept %v, this Peer is not connected", fileName)
+	}
+	p.mu.Lock()
+	shared.registered = true
+	p.mu.Unlock()
 	fmt.Printf("Registered file %v\n", fileName)
 	return nil
 }
 
+/*
+	Withdraws a registered file from the FileShare system.
+	The file stays on disk but is no longer served to
+	other Peers or returned by the Server's searches.
+*/
+func (p *Peer) UnregisterFile(fileName string) error {
+	p.mu.Lock()
+	if _, ok := p.files[fileName]; !ok {
+		p.mu.Unlock()
+		return fmt.Errorf("%v is not published", fileName)
+	}
+	delete(p.files, fileName)
+	p.unpublished[fileName] = true
+	p.savePublished()
+	p.mu.Unlock()
+
+	request := protocol.PeerSendFile{}
+	reply := protocol.ServerReceiveFile{}
+	request.FileName = fileName
+	request.PeerID = p.peerID()
+	if err := p.serverCall(protocol.ServerUnregister, &request, &reply); err != nil {
+		return err
+	}
+	if !reply.Accepted {
+		return fmt.Errorf("the server did not list %v for this Peer", fileName)
+	}
+	fmt.Printf("Unregistered file %v\n", fileName)
+	return nil
+}
+
+/*
+	Returns the names of the registered files, sorted.
+	The caller must hold p.mu.
+*/
+func (p *Peer) fileNames() []string {
+	names := make([]string, 0, len(p.files))
+	for name := range p.files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
 /*
 	Asks the Server for a particular file.
 	The Server will search the network of Peers
-	and find the Peer with the requested file, and
-	then send the connection details back to the
-	requesting Peer.
+	and find every Peer with the requested file, and
+	then send the connection details and the metadata
+	of each copy back to the requesting Peer. If the
+	Peers hold different contents under that name the
+	user picks one, then the chosen copy is downloaded
+	in chunks from all the Peers holding it at once.
+	A directory is downloaded file by file, see fetchDir().
+	Encrypted shares are decrypted if this Peer is a recipient.
 */
 func (p *Peer) SearchForFile(fileName string) error {
-	p.mu.Lock()
-
-	request := RequestFileArgs{}
-	reply := FindPeerReply{}
-	request.File = fileName
-	request.PeerID = p.PeerID
-	serverCall("Server.SearchFile", &request, &reply)
+	reply, copies, err := p.findCopies(fileName)
+	if err != nil {
+		return err
+	}
 
-	if reply.Found {
-		fmt.Printf("Num      PeerID\n")
-		for i := 0; i < len(reply.PeerID); i++ {
-			fmt.Printf("%v        %v\n", i+1, reply.PeerID[i])
+	if reply.Found && reply.Dir {
+		if _, failed := p.fetchDir(&reply, p.directory, true); len(failed) > 0 {
+			return fmt.Errorf("could not download %v", strings.Join(failed, ", "))
 		}
+	} else if reply.Found {
+		printCopies(copies)
 
-		fmt.Printf("Please choose a PeerID to connect to: ")
-		var id int
-		fmt.Scanf("%d", &id)
+		choice := 1
+		if len(copies) > 1 {
+			fmt.Printf("Several different files are named %v, please choose one: ", fileName)
+			line, _ := stdin.ReadString('\n')
+			choice, err = strconv.Atoi(strings.TrimSpace(line))
+			if err != nil || choice < 1 || choice > len(copies) {
+				fmt.Printf("Invalid choice\n")
+				return nil
+			}
+		}
+		target := copies[choice-1].Info
+		filePath, err := savePath(p.directory, target.Name)
+		if err != nil {
+			return err
+		}
 
-		p.ConnectPeer(reply.Port[id], reply.PeerID[id])
-		save := p.RequestFile(reply.Port[id], reply.PeerID[id], reply.File)
-		p.mu.Unlock()
-		if save == true{
-			p.RegisterFile(reply.File, p.directory)
+		if _, save := p.SwarmDownload(&reply, &target, filePath); save == true {
+			if err := p.RegisterFile(target.Name, p.directory, target.Description, target.Tags, target.Access); err != nil {
+				fmt.Printf("Error registering file %v: %v\n", target.Name, err)
+			}
+			if _, err := decryptInRoot(&target, filePath, p.directory); err != nil {
+				fmt.Printf("Error: %v\n", err)
+			}
 		}
 	} else{
 		fmt.Printf("File %v not found\n", fileName)
-		p.mu.Unlock()
 	}
 	return nil
 }
 
 /*
-	Saves a newly received file to the Peer's repository.
+	One content published under a file name, and the
+	number of Peers holding it.
+*/
+type fileCopy struct {
+	Info    protocol.FileInfo `json:"info"`
+	Holders int               `json:"holders"`
+}
+
+/*
+	Asks the Server which Peers hold a file. Returns its reply and
+	the different contents published under that name.
 */
+func (p *Peer) findCopies(fileName string) (protocol.FindPeerReply, []fileCopy, error) {
+	request := protocol.RequestFileArgs{}
+	reply := protocol.FindPeerReply{}
+	request.File = fileName
+	request.PeerID = p.peerID()
+	if err := p.serverCall(protocol.ServerSearchFile, &request, &reply); err != nil {
+		return reply, nil, err
+	}
 
-func saveFile(fileName string, fileContents []byte, id int, directory string) bool{
-	filePath, _ := filepath.Abs(directory + fileName)
-	f, err := os.Create(filePath)
+	copies := []fileCopy{}
+	index := map[string]int{}
+	for _, info := range reply.Info {
+		i, ok := index[info.Hash]
+		if !ok {
+			i = len(copies)
+			index[info.Hash] = i
+			copies = append(copies, fileCopy{Info: info})
+		}
+		copies[i].Holders++
+	}
+	return reply, copies, nil
+}
+
+func printCopies(copies []fileCopy) {
+	fmt.Printf("Num      Size         Type                     Modified             Peers    Hash\n")
+	for i, c := range copies {
+		info := c.Info
+		fmt.Printf("%-8v %-12v %-24v %-20v %-8v %.12v\n", i+1, info.Size, info.MimeType, info.ModTime.Format("2006-01-02 15:04:05"), c.Holders, info.Hash)
+		if info.Description != "" || len(info.Tags) > 0 || len(info.Access) > 0 || info.Encrypted {
+			fmt.Printf("         %v %v %v\n", info.Description, info.FormatTags(), info.FormatAccess())
+		}
+	}
+}
+
+/*
+	Saves a newly received file to filePath. Chunks are
+	fetched concurrently from all the given sources and each chunk is
+	written as soon as it arrives. When a source is dropped, next (if
+	not nil) is asked for another one to take its place. The data goes to a ".part" file
+	that is only renamed to its final name once every chunk is on
+	disk and the whole file matches its SHA-256; chunks recorded in the sidecar state by an earlier,
+	interrupted fetch are not fetched again. If the whole file does not
+	match, the chunks on disk that fail their own hash are fetched
+	again and the others are kept.
+*/
+func saveFile(sources []*swarmSource, next func() *swarmSource, target *protocol.FileInfo, id int, filePath string) bool {
+	fileName := target.Name
+	filePath, _ = filepath.Abs(filePath)
+	state, resumed := loadDownloadState(filePath, target)
+	if resumed {
+		fmt.Printf("Resuming %v, %v/%v chunks already downloaded\n", fileName, state.completed(), len(state.Done))
+	}
+
+	flags := os.O_RDWR | os.O_CREATE
+	if !resumed {
+		flags |= os.O_TRUNC
+	}
+	f, err := os.OpenFile(partPath(filePath), flags, 0644)
 	if err != nil {
 		fmt.Printf("Error creating the file: %v\n", err)
 		return false
 	}
+	defer f.Close()
+	if err := state.save(); err != nil {
+		fmt.Printf("Error saving download state: %v\n", err)
+		return false
+	}
 
-	l, err := f.Write(fileContents)
-	if err != nil {
-		fmt.Printf("Error writing the file: %v %v\n", err, l)
+	pending := make(chan int, len(state.Done))
+	remaining := 0
+	for i, done := range state.Done {
+		if !done {
+			pending <- i
+			remaining++
+		}
+	}
+	results := make(chan chunkResult)
+	stop := make(chan struct{})
+	defer close(stop)
+
+	active := len(sources)
+	for _, s := range sources {
+		go s.work(f, target, id, pending, results, stop)
+	}
+
+	refetched := false
+	for {
+		for remaining > 0 {
+			if active == 0 {
+				fmt.Printf("Error receiving %v: every source failed, %v chunks missing\n", fileName, remaining)
+				return false
+			}
+
+			r := <-results
+			if r.err != nil {
+				fmt.Printf("Error receiving chunk %v from Peer %v: %v\n", r.index, r.source.PeerID, r.err)
+				pending <- r.index
+			}
+			if r.retire {
+				active--
+				r.source.retired = true
+				fmt.Printf("Dropped Peer %v from the download: %v\n", r.source.PeerID, r.err)
+				if next != nil {
+					if s := next(); s != nil {
+						sources = append(sources, s)
+						active++
+						go s.work(f, target, id, pending, results, stop)
+					}
+				}
+			}
+			if r.err != nil {
+				continue
+			}
+
+			if err := f.Sync(); err != nil {
+				fmt.Printf("Error writing the file: %v\n", err)
+				return false
+			}
+			r.source.served++
+			state.Done[r.index] = true
+			remaining--
+			if err := state.save(); err != nil {
+				fmt.Printf("Error saving download state: %v\n", err)
+				return false
+			}
+		}
+
+		if err := f.Truncate(target.Size); err != nil {
+			fmt.Printf("Error writing the file: %v\n", err)
+			return false
+		}
+		hash, chunks, err := hashFile(partPath(filePath))
+		if err != nil {
+			fmt.Printf("Error reading the file: %v\n", err)
+			return false
+		}
+		if hash == target.Hash {
+			break
+		}
+
+		// Chunks are checked as they arrive, so only chunks left on
+		// disk by an earlier fetch can be bad. Those are fetched again.
+		bad := []int{}
+		for i, want := range target.ChunkHashes {
+			if i >= len(chunks) || chunks[i] != want {
+				bad = append(bad, i)
+			}
+		}
+		if len(bad) == 0 {
+			// Every chunk matches but the whole file does not,
+			// the published hashes contradict each other.
+			fmt.Printf("Error receiving %v: the file failed verification, discarding it\n", fileName)
+			os.Remove(partPath(filePath))
+			state.remove()
+			return false
+		}
+		for _, i := range bad {
+			state.Done[i] = false
+		}
+		if err := state.save(); err != nil {
+			fmt.Printf("Error saving download state: %v\n", err)
+			return false
+		}
+		if refetched {
+			fmt.Printf("Error receiving %v: %v chunks failed verification, fetch it again to retry them\n", fileName, len(bad))
+			return false
+		}
+		fmt.Printf("%v chunks of %v on disk failed verification, fetching them again\n", len(bad), fileName)
+		refetched = true
+		for _, i := range bad {
+			pending <- i
+			remaining++
+		}
+	}
+
+	if err := f.Close(); err != nil {
+		fmt.Printf("Error writing the file: %v\n", err)
+		return false
+	}
+	if err := os.Rename(partPath(filePath), filePath); err != nil {
+		fmt.Printf("Error renaming the file: %v\n", err)
 		return false
 	}
+	state.remove()
+	for _, s := range sources {
+		if s.served > 0 {
+			fmt.Printf("Received %v chunks of %v from Peer %v (%v)\n", s.served, fileName, s.PeerID, s.Addr)
+		}
+	}
 	fmt.Printf("Saved file successfully %v\n", fileName)
 	return true
 }
 
-func (p* Peer) ListFileReply(request *RequestListFile, reply *ListFileReply) error{
-	reply.File = p.files
+func (p* Peer) ListFileReply(request *protocol.RequestListFile, reply *protocol.ListFileReply) error{
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	// The Server already has the metadata of every file, so
+	// only other Peers are limited to the files they may access.
+	for _, name := range p.fileNames() {
+		info := p.files[name].Info
+		if request.CertName == protocol.TrackerName || info.Allows(request.CertName, request.Groups) {
+			reply.File = append(reply.File, name)
+			reply.Info = append(reply.Info, info)
+		}
+	}
 	reply.PeerID = p.PeerID
-	reply.NumFiles = p.numFiles
+	reply.NumFiles = len(reply.File)
 	reply.Accepted = true
 
 	return nil
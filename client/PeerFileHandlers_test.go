@@ -0,0 +1,126 @@
+package main
+
+import (
+	"net/http"
+	"net/rpc"
+	"testing"
+	"time"
+
+	"github.com/junvalentine/FileSharing/protocol"
+)
+
+func TestServeRestricted(t *testing.T) {
+	repo, _ := makeRepo(t)
+	p := &Peer{directory: repo + "/", files: map[string]*sharedFile{}, uploads: map[int]time.Time{}}
+	p.files["notes.txt"] = &sharedFile{Location: repo + "/", Info: protocol.FileInfo{Access: []string{"bob", "@team"}}}
+
+	callers := []struct {
+		certName string
+		groups   []string
+		allowed  bool
+	}{
+		{"bob", nil, true},
+		{"carol", []string{"ops", "team"}, true},
+		{"dave", []string{"ops"}, false},
+		{"", nil, false},
+		{"@team", nil, false},
+	}
+	for _, c := range callers {
+		file := protocol.RequestFileArgs{File: "notes.txt", CertName: c.certName, Groups: c.groups}
+		fileReply := protocol.RequestFileReply{}
+		if err := p.ServeFile(&file, &fileReply); err != nil {
+			t.Fatal(err)
+		}
+		chunk := protocol.RequestChunkArgs{File: "notes.txt", CertName: c.certName, Groups: c.groups}
+		chunkReply := protocol.RequestChunkReply{}
+		if err := p.ServeChunk(&chunk, &chunkReply); err != nil {
+			t.Fatal(err)
+		}
+		if fileReply.FileExists != c.allowed || chunkReply.FileExists != c.allowed {
+			t.Errorf("%q in %v: ServeFile %v, ServeChunk %v, want %v", c.certName, c.groups, fileReply.FileExists, chunkReply.FileExists, c.allowed)
+		}
+
+		list := protocol.RequestListFile{CertName: c.certName, Groups: c.groups}
+		listReply := protocol.ListFileReply{}
+		if err := p.ListFileReply(&list, &listReply); err != nil {
+			t.Fatal(err)
+		}
+		if listed := listReply.NumFiles == 1; listed != c.allowed {
+			t.Errorf("%q in %v: listed %v, want %v", c.certName, c.groups, listed, c.allowed)
+		}
+	}
+}
+
+/*
+	Stands in for the Server, accepting files or not, and
+	records the files registered and whether the Peer held
+	its lock during a call.
+*/
+type fakeTracker struct {
+	p          *Peer
+	accept     bool
+	locked     bool
+	registered []string
+}
+
+/*
+	Starts a fakeTracker for p and points p at it.
+*/
+func startTracker(t *testing.T, p *Peer, accept bool) *fakeTracker {
+	t.Helper()
+	tracker := &fakeTracker{p: p, accept: accept}
+	serv := rpc.NewServer()
+	serv.RegisterName("Server", tracker)
+	mux := http.NewServeMux()
+	mux.Handle(rpc.DefaultRPCPath, protocol.NewHandler(serv, nil))
+	l, err := protocol.Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go http.Serve(l, mux)
+	p.Tracker = l.Addr().String()
+	return tracker
+}
+
+func (m *fakeTracker) Register(request *protocol.PeerSendFile, reply *protocol.ServerReceiveFile) error {
+	if m.accept {
+		m.registered = append(m.registered, request.FileName)
+	}
+	return m.reply(reply)
+}
+
+func (m *fakeTracker) Unregister(request *protocol.PeerSendFile, reply *protocol.ServerReceiveFile) error {
+	return m.reply(reply)
+}
+
+func (m *fakeTracker) reply(reply *protocol.ServerReceiveFile) error {
+	if m.p.mu.TryLock() {
+		m.p.mu.Unlock()
+	} else {
+		m.locked = true
+	}
+	reply.Accepted = m.accept
+	return nil
+}
+
+func TestRegisterFile(t *testing.T) {
+	repo, _ := makeRepo(t)
+	p := &Peer{directory: repo + "/", files: map[string]*sharedFile{}, unpublished: map[string]bool{}}
+	tracker := startTracker(t, p, false)
+
+	for _, accept := range []bool{true, false} {
+		tracker.accept = accept
+		err := p.RegisterFile("notes.txt", repo+"/", "", nil, nil)
+		if (err == nil) != accept {
+			t.Errorf("RegisterFile with Accepted %v: %v", accept, err)
+		}
+		err = p.UnregisterFile("notes.txt")
+		if (err == nil) != accept {
+			t.Errorf("UnregisterFile with Accepted %v: %v", accept, err)
+		}
+	}
+	if tracker.locked {
+		t.Errorf("p.mu was held while calling the Server")
+	}
+}
@@ -0,0 +1,455 @@
+/*
+	This file contains the Peer's non-interactive commands. Each one
+	runs once and exits with one of the exit codes below, so the Peer
+	can be scripted:
+		serve                                  share the repository until interrupted
+		publish [-to a.crt,...] <path> [#tag ...] [+name|+@group ...] [description]
+		fetch [-o dest] [-hash H] <name>
+		search [search flags] <query>
+		ls                                     list the published files
+	With -json the result of the command is printed on stdout as JSON,
+	and everything else the Peer prints goes to stderr.
+
+	"publish" and "fetch" register files under the repository's
+	identity and in its published list, so a "serve" running on the
+	same repository starts sharing them (see watch.go).
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/junvalentine/FileSharing/protocol"
+)
+
+const usage = `Usage: peer [flags] [command]
+
+Without a command the Peer starts an interactive prompt. Commands:
+  serve                                     share the repository until interrupted
+  publish [-to a.crt,...] <path> [#tag ...] [+name|+@group ...] [description]
+                                            publish a file, or every file in a directory,
+                                            only to the Peers or groups given with +, or
+                                            encrypted for the certificates given with -to
+  fetch [-o dest] [-hash H] <name>          download a file, or a directory and its tree
+  search [search flags] <query>             search the files on the tracker
+  ls                                        list the published files
+
+Flags:
+`
+
+/*
+	Exit codes of the commands.
+*/
+const (
+	exitOK          = 0
+	exitFailure     = 1
+	exitUsage       = 2
+	exitNotFound    = 3
+	exitUnreachable = 4
+	exitAmbiguous   = 5
+)
+
+/*
+	An error a command failed with, and the exit code it maps to.
+*/
+type commandError struct {
+	code int
+	err  error
+}
+
+func (e *commandError) Error() string {
+	return e.err.Error()
+}
+
+func fail(code int, format string, args ...interface{}) error {
+	return &commandError{code, fmt.Errorf(format, args...)}
+}
+
+/*
+	Returns the exit code for an error returned by a command.
+*/
+func exitCode(err error) int {
+	var cmdErr *commandError
+	if errors.As(err, &cmdErr) {
+		return cmdErr.code
+	}
+	if protocol.Temporary(err) {
+		return exitUnreachable
+	}
+	return exitFailure
+}
+
+/*
+	Runs the command in args and returns the exit code.
+*/
+func runCommand(conf Config, args []string) int {
+	jsonOut := conf.JSON
+	rest := []string{}
+	for _, arg := range args[1:] {
+		if arg == "-json" || arg == "--json" {
+			jsonOut = true
+		} else {
+			rest = append(rest, arg)
+		}
+	}
+
+	out := os.Stdout
+	if jsonOut {
+		os.Stdout = os.Stderr
+	}
+
+	p, err := MakePeer(conf.Repo, conf.Listen, conf.Tracker, conf.Advertise, conf.Token)
+	if err != nil {
+		return reportError(out, jsonOut, err)
+	}
+	p.PeerID = -1
+
+	var result interface{}
+	switch args[0] {
+	case "serve":
+		err = p.runServe(out, jsonOut)
+	case "publish":
+		result, err = p.runPublish(rest)
+	case "fetch":
+		result, err = p.runFetch(rest)
+	case "search":
+		result, err = p.runSearch(rest)
+	case "ls":
+		result, err = p.runLs()
+	default:
+		err = fail(exitUsage, "unknown command %q, see peer -h", args[0])
+	}
+
+	if err != nil {
+		return reportError(out, jsonOut, err)
+	}
+	if jsonOut && result != nil {
+		writeJSON(out, result)
+	}
+	return exitOK
+}
+
+/*
+	Prints the error a command failed with and returns its exit code.
+*/
+func reportError(out io.Writer, jsonOut bool, err error) int {
+	if jsonOut {
+		writeJSON(out, map[string]interface{}{"error": err.Error(), "code": exitCode(err)})
+	} else {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+	}
+	return exitCode(err)
+}
+
+func writeJSON(w io.Writer, v interface{}) {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
+
+/*
+	Parses flags placed anywhere among the arguments of a command
+	and returns the other arguments.
+*/
+func parseArgs(fs *flag.FlagSet, args []string) ([]string, error) {
+	fs.SetOutput(os.Stderr)
+	positional := []string{}
+	for {
+		if err := fs.Parse(args); err != nil {
+			return nil, fail(exitUsage, "%v", err)
+		}
+		if fs.NArg() == 0 {
+			return positional, nil
+		}
+		positional = append(positional, fs.Arg(0))
+		args = fs.Args()[1:]
+	}
+}
+
+/*
+	Connects to the Server for a command that needs a PeerID.
+	The command does not serve the files it publishes or fetches,
+	a "serve" on the same repository does (see watch.go).
+*/
+func (p *Peer) connect() error {
+	if _, err := p.connectServer(true); err != nil {
+		return fmt.Errorf("connecting to the server: %w", err)
+	}
+	return nil
+}
+
+/*
+	Shares the repository like the interactive Peer does, until
+	the process is interrupted.
+*/
+func (p *Peer) runServe(out io.Writer, jsonOut bool) error {
+	if err := p.peerServer(p.Port); err != nil {
+		return fail(exitFailure, "listening on %v: %v", p.Port, err)
+	}
+	reply, err := p.connectServer(false)
+	if err != nil {
+		return fmt.Errorf("connecting to the server: %w", err)
+	}
+	p.restorePublished(reply.Files)
+	go p.sendHeartbeats()
+	go p.watchFiles(watchInterval)
+
+	p.mu.Lock()
+	status := map[string]interface{}{"peerId": p.PeerID, "listen": p.Port, "files": p.fileNames()}
+	p.mu.Unlock()
+	if jsonOut {
+		writeJSON(out, status)
+	}
+	fmt.Printf("Serving %v on %v, press Ctrl-C to stop\n", p.directory, p.Port)
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	<-sig
+	p.Shutdown()
+	return nil
+}
+
+/*
+	Publishes one file and returns its metadata, or every
+	file in a directory and returns the metadata of each.
+	With -to the file is encrypted for the Peers whose
+	certificates are given, and the encrypted copy is
+	published instead (see crypt.go).
+*/
+func (p *Peer) runPublish(args []string) (interface{}, error) {
+	fs := flag.NewFlagSet("publish", flag.ContinueOnError)
+	to := fs.String("to", "", "comma-separated certificates of the Peers to encrypt the file for")
+	args, err := parseArgs(fs, args)
+	if err != nil {
+		return nil, err
+	}
+	if len(args) < 1 {
+		return nil, fail(exitUsage, "usage: peer publish [-to a.crt,b.crt] <path> [#tag ...] [+name|+@group ...] [description]")
+	}
+	path, err := filepath.Abs(args[0])
+	if err != nil {
+		return nil, err
+	}
+	stat, err := os.Stat(path)
+	if err != nil {
+		return nil, fail(exitNotFound, "%v", err)
+	}
+
+	if err := p.connect(); err != nil {
+		return nil, err
+	}
+	description, tags, access := parseDescription(args[1:])
+	name := filepath.Base(path)
+	location := filepath.Dir(path) + "/"
+	if *to != "" {
+		if stat.IsDir() {
+			return nil, fail(exitUsage, "encrypt the files of %v one at a time", name)
+		}
+		if name, err = p.encryptShare(path, strings.Split(*to, ",")); err != nil {
+			return nil, err
+		}
+		location = p.directory
+	} else if stat.IsDir() {
+		names, err := p.PublishDir(name, location, description, tags, access)
+		if err != nil {
+			return nil, err
+		}
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		infos := []protocol.FileInfo{}
+		for _, name := range names {
+			infos = append(infos, p.files[name].Info)
+		}
+		return infos, nil
+	}
+	if err := p.RegisterFile(name, location, description, tags, access); err != nil {
+		return nil, err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.files[name].Info, nil
+}
+
+/*
+	Result of the fetch command.
+*/
+type fetchResult struct {
+	File      string     `json:"file"`
+	Path      string     `json:"path"`
+	Size      int64      `json:"size"`
+	Hash      string     `json:"hash"`
+	ServedBy  []servedBy `json:"servedBy"`
+	Decrypted string     `json:"decrypted,omitempty"`
+}
+
+/*
+	Downloads one file, into the repository (where it is then
+	published) or to the path given with -o. A directory is
+	downloaded with its tree, into the repository or under
+	the directory given with -o. An encrypted share is also
+	decrypted, if this Peer is one of its recipients.
+*/
+func (p *Peer) runFetch(args []string) (interface{}, error) {
+	fs := flag.NewFlagSet("fetch", flag.ContinueOnError)
+	dest := fs.String("o", "", "file or directory to save the file to instead of the repository")
+	hash := fs.String("hash", "", "hash (or prefix) of the copy to fetch when several files have the name")
+	names, err := parseArgs(fs, args)
+	if err != nil {
+		return nil, err
+	}
+	if len(names) != 1 {
+		return nil, fail(exitUsage, "usage: peer fetch [-o dest] [-hash H] <name>")
+	}
+	name := names[0]
+
+	if err := p.connect(); err != nil {
+		return nil, err
+	}
+	reply, copies, err := p.findCopies(name)
+	if err != nil {
+		return nil, err
+	}
+	if !reply.Found {
+		return nil, fail(exitNotFound, "file %v not found", name)
+	}
+	if reply.Dir {
+		root := p.directory
+		if *dest != "" {
+			root = *dest
+		}
+		saved, failed := p.fetchDir(&reply, root, *dest == "")
+		if len(failed) > 0 {
+			return nil, fail(exitFailure, "could not download %v", strings.Join(failed, ", "))
+		}
+		return saved, nil
+	}
+
+	if *hash != "" {
+		matching := []fileCopy{}
+		for _, c := range copies {
+			if strings.HasPrefix(c.Info.Hash, *hash) {
+				matching = append(matching, c)
+			}
+		}
+		copies = matching
+	}
+	if len(copies) == 0 {
+		return nil, fail(exitNotFound, "no copy of %v has a hash starting with %v", name, *hash)
+	}
+	if len(copies) > 1 {
+		printCopies(copies)
+		return nil, fail(exitAmbiguous, "several different files are named %v, choose one with -hash", name)
+	}
+	target := copies[0].Info
+
+	// The name comes from the Server, so it is saved through a
+	// sandbox unless the user gave the whole path with -o.
+	root := p.directory
+	if stat, err := os.Stat(*dest); err == nil && stat.IsDir() || strings.HasSuffix(*dest, "/") {
+		root = *dest
+	}
+	var filePath string
+	if *dest != "" && root != *dest {
+		filePath, _ = filepath.Abs(*dest)
+		err = os.MkdirAll(filepath.Dir(filePath), 0755)
+	} else {
+		filePath, err = savePath(root, target.Name)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	served, ok := p.SwarmDownload(&reply, &target, filePath)
+	if !ok {
+		return nil, fail(exitFailure, "could not download %v", name)
+	}
+	if *dest == "" {
+		if err := p.RegisterFile(target.Name, p.directory, target.Description, target.Tags, target.Access); err != nil {
+			fmt.Printf("Error registering file %v: %v\n", target.Name, err)
+		}
+	}
+	// Decrypted next to the encrypted copy, which is kept.
+	var plainPath string
+	if *dest != "" && root != *dest {
+		plainPath, err = decryptFetched(&target, filePath, plainName(filePath))
+	} else {
+		plainPath, err = decryptInRoot(&target, filePath, root)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return fetchResult{target.Name, filePath, target.Size, target.Hash, served, plainPath}, nil
+}
+
+/*
+	Searches the files registered on the Server.
+*/
+func (p *Peer) runSearch(args []string) (interface{}, error) {
+	request, err := parseSearchArgs(args)
+	if err != nil {
+		return nil, fail(exitUsage, "%v", err)
+	}
+	reply, err := p.searchFiles(request)
+	if err != nil {
+		return nil, err
+	}
+	printSearchReply(&request, &reply)
+	return reply, nil
+}
+
+/*
+	One published file, as listed by the ls command.
+*/
+type lsEntry struct {
+	Name        string    `json:"name"`
+	Path        string    `json:"path"`
+	Size        int64     `json:"size"`
+	ModTime     time.Time `json:"modTime"`
+	Description string    `json:"description"`
+	Tags        []string  `json:"tags"`
+	Access      []string  `json:"access,omitempty"`
+	Missing     bool      `json:"missing"`
+}
+
+/*
+	Lists the files published from the repository.
+*/
+func (p *Peer) runLs() (interface{}, error) {
+	entries := []lsEntry{}
+	for _, e := range p.readPublished() {
+		entry := lsEntry{Name: e.Name, Path: e.Location + e.Name, Description: e.Description, Tags: e.Tags, Access: e.Access}
+		if stat, err := os.Stat(entry.Path); err == nil {
+			entry.Size = stat.Size()
+			entry.ModTime = stat.ModTime()
+		} else {
+			entry.Missing = true
+		}
+		entries = append(entries, entry)
+	}
+
+	fmt.Printf("Num      Size         Modified             Files\n")
+	for i, e := range entries {
+		modified := e.ModTime.Format("2006-01-02 15:04:05")
+		if e.Missing {
+			modified = "(missing)"
+		}
+		fmt.Printf("%-8v %-12v %-20v %v\n", i+1, e.Size, modified, e.Path)
+		if e.Description != "" || len(e.Tags) > 0 || len(e.Access) > 0 {
+			info := protocol.FileInfo{Tags: e.Tags, Access: e.Access}
+			fmt.Printf("         %v %v %v\n", e.Description, info.FormatTags(), info.FormatAccess())
+		}
+	}
+	return entries, nil
+}
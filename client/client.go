@@ -1,41 +1,49 @@
 package main
 
 import (
+	"context"
 	"fmt"
-	"log"
 	"net"
 	"net/http"
 	"net/rpc"
 	"sync"
+	"time"
+
+	"github.com/junvalentine/FileSharing/protocol"
 )
 
 /*
 	Struct type for the Peers.
 */
 type Peer struct {
-	PeerID    int
-	files     []string
-	fileloc   []string
-	peers     []int
-	numFiles  int
-	numPeers  int
-	directory string
-	Port      string
-	mu        sync.Mutex
+	PeerID      int
+	Identity    string
+	files       map[string]*sharedFile
+	unpublished map[string]bool
+	peers       map[int]bool
+	uploads     map[int]time.Time
+	history     map[int]float64
+	directory   string
+	Port        string
+	Advertise   string
+	Tracker     string
+	lease       time.Duration
+	listener    net.Listener
+	token       string
+	closing     bool
+	inflight    int
+	mu          sync.Mutex
 }
 
 /*
-	A lightweight data type for the Server and Peers to
-	hold relevant information about the Peers connected
-	to it, including their port and the files they posses.
+	A file the Peer shares: the directory it is in
+	and the metadata registered with the Server.
+	registered is false until the Server accepted it.
 */
-type PeerInfo struct {
-	PeerID      int
-	Port        string
-	Files       [100]string
-	// Fileloc		[100]string
-	numFiles    int
-	isConnected bool
+type sharedFile struct {
+	Location   string
+	Info       protocol.FileInfo
+	registered bool
 }
 
 
@@ -43,90 +51,135 @@ func (m *Peer) Welcome() {
 	fmt.Printf("Welcome to the File-Sharing Application\n")
 }
 /*
-	Method used to make Remote Procedure Calls (RPCs)
-	Adopted from provided lab code.
+	Returns ctx for calls to the Server: they send the Peer's
+	join token, and with TLS only accept the Server's certificate.
 */
-func call(rpcname string, args interface{}, reply interface{}, port string) bool {
-	c, err := rpc.DialHTTP("tcp", port)
-	if err != nil {
-		log.Fatal("dialing:", err)
-	}
-	defer c.Close()
-
-	err = c.Call(rpcname, args, reply)
-	if err == nil {
-		return true
-	}
-	fmt.Println(err)
-	return false
+func (p *Peer) trackerContext(ctx context.Context) context.Context {
+	ctx = protocol.ExpectName(ctx, protocol.TrackerName)
+	return protocol.WithToken(ctx, p.token)
 }
 
 /*
 	Method for the Peers to make RPC calls to the Server.
+	Transient failures are retried, see protocol.Call().
 */
-func serverCall(rpcname string, args interface{}, reply interface{}) bool {
-	c, err := rpc.DialHTTP("tcp", "192.168.32.101:1337")
-	if err != nil {
-		log.Fatal("dialing:", err)
-	}
-	defer c.Close()
-
-	err = c.Call(rpcname, args, reply)
-	if err == nil {
-		return true
-	}
-	fmt.Println(err)
-	return false
+func (p *Peer) serverCall(rpcname string, args interface{}, reply interface{}) error {
+	return protocol.Call(p.trackerContext(context.Background()), p.Tracker, rpcname, args, reply)
 }
 
 /*
 	Creates a server for the Peer so that other Peers can connect.
+	With TLS only Peers holding a certificate of the CA can.
 */
-func (p *Peer) peerServer(port string) {
-	rpc.Register(p)
+func (p *Peer) peerServer(port string) error {
 	serv := rpc.NewServer()
 	serv.Register(p)
-	oldMux := http.DefaultServeMux
 	mux := http.NewServeMux()
-	http.DefaultServeMux = mux
-	serv.HandleHTTP(rpc.DefaultRPCPath, rpc.DefaultDebugPath)
-	http.DefaultServeMux = oldMux
-	l, err := net.Listen("tcp", port)
+	mux.Handle(rpc.DefaultRPCPath, protocol.NewHandler(serv, nil))
+	l, err := protocol.Listen(port)
 	if err != nil {
-		panic(err)
+		return err
 	}
+	p.listener = l
 	go http.Serve(l, mux)
+	return nil
 }
 
 /*
-	Method called to create a new Peer.
+	Method called to create a new Peer. Fails if the
+	repository cannot hold the Peer's identity, e.g.
+	because it does not exist.
 */
-func MakePeer(directory string, port string) *Peer {
+func MakePeer(directory string, port string, tracker string, advertise string, token string) (*Peer, error) {
 	p := Peer{}
 
 	// p.PeerID = id
 	p.directory = directory 
-	p.files = make([]string, 100)
-	p.fileloc = make([]string, 100)
+	p.files = map[string]*sharedFile{}
+	p.unpublished = map[string]bool{}
 	p.Port = port
-	p.numFiles = 0
-	p.peers = make([]int, 100)
-	p.numPeers = 0
+	p.Advertise = advertise
+	p.Tracker = tracker
+	p.token = token
+	p.peers = map[int]bool{}
+	p.uploads = map[int]time.Time{}
+	p.history = map[int]float64{}
+
+	identity, err := loadIdentity(directory)
+	if err != nil {
+		return nil, fmt.Errorf("repository %v: %v", directory, err)
+	}
+	p.Identity = identity
+	return &p, nil
+}
 
-	p.peerServer(port)
-	return &p
+/*
+	Connects the Peer to the Server. Returns false if the Server
+	refused the connection, e.g. because of a protocol mismatch.
+	Once connected, the files published before the Peer last
+	stopped are published again.
+*/
+func (p *Peer) ConnectServer() bool {
+	reply, err := p.connectServer(false)
+	if err != nil {
+		fmt.Printf("Could not connect to the server: %v\n", err)
+		return false
+	}
+	p.restorePublished(reply.Files)
+	return true
 }
 
-func (p *Peer) ConnectServer() {
-	request := ConnectRequest{}
-	reply := ConnectReply{}
+/*
+	Connects the Peer to the Server without publishing anything.
+	Commands that only run once connect as oneShot, so the Server
+	keeps listing the Peer at the address of the process serving
+	the repository, if any, rather than at one nobody listens on.
+*/
+func (p *Peer) connectServer(oneShot bool) (protocol.ConnectReply, error) {
+	request := protocol.ConnectRequest{}
+	reply := protocol.ConnectReply{}
 	// request.PeerID = p.PeerID
+	request.Version = protocol.Version
+	request.Identity = p.Identity
 	request.Port = p.Port
-	serverCall("Server.ConnectPeer", &request, &reply)
+	request.Host = p.Advertise
+	request.OneShot = oneShot
+	if err := p.serverCall(protocol.ServerConnectPeer, &request, &reply); err != nil {
+		return reply, err
+	}
+	if reply.Accepted == false {
+		return reply, fmt.Errorf("the server refused the connection")
+	}
+	p.mu.Lock()
 	p.PeerID = reply.PeerID
-	if reply.Accepted == true {
-		fmt.Printf("Connected to server, PeerID: %v\n", p.PeerID)
+	p.lease = reply.Lease
+	p.mu.Unlock()
+	if reply.Returning {
+		fmt.Printf("Reconnected to server, PeerID: %v\n", reply.PeerID)
+	} else {
+		fmt.Printf("Connected to server, PeerID: %v\n", reply.PeerID)
 	}
+	return reply, nil
+}
+
+/*
+	Returns the PeerID the Server gave the Peer. The heartbeats
+	change it when they reconnect, so it is only read under the lock.
+*/
+func (p *Peer) peerID() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.PeerID
+}
+
+/*
+	Returns how long the Server keeps the Peer listed
+	without a heartbeat.
+*/
+func (p *Peer) leaseTime() time.Duration {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.lease
 }
 
 /*
@@ -147,17 +200,21 @@ func (p *Peer) ConnectServer() {
 // 	fmt.Printf("Connected to Peer: %v\n", request.PeerID)
 // 	return nil
 // }
-func (p *Peer) AcceptConnect(request *ConnectRequest, reply *ConnectReply) error {
+func (p *Peer) AcceptConnect(request *protocol.ConnectRequest, reply *protocol.ConnectReply) error {
     done := make(chan bool) // create a new channel
 
     go func() { // start a new goroutine
         defer func() { done <- true }() // ensure done is always sent on exit
         fmt.Printf("Received ConnectRequest from Peer %v\n", request.PeerID)
+        if err := protocol.CheckVersion(request.Version); err != nil {
+            fmt.Printf("Refused connection from Peer %v: %v\n", request.PeerID, err)
+            reply.Accepted = false
+            return
+        }
         p.mu.Lock() // acquire the lock before updating shared data
         defer p.mu.Unlock()
-        p.peers[p.numPeers] = request.PeerID
+        p.peers[request.PeerID] = true
         reply.PeerID = request.PeerID
-        p.numPeers = p.numPeers + 1
         reply.Accepted = true
         fmt.Printf("Accepted connection from Peer %v\n", request.PeerID)
     }()
@@ -166,20 +223,25 @@ func (p *Peer) AcceptConnect(request *ConnectRequest, reply *ConnectReply) error
     return nil
 }
 /*
-	Connects the Peer to the provided Peer.
+	Connects the Peer to the provided Peer over an
+	already dialed source.
 */
-func (p *Peer) ConnectPeer(port string, id int) {
-	request := ConnectRequest{}
-	reply := ConnectReply{}
-	request.PeerID = p.PeerID
+func (p *Peer) ConnectPeer(ctx context.Context, s *swarmSource) bool {
+	request := protocol.ConnectRequest{}
+	reply := protocol.ConnectReply{}
+	request.Version = protocol.Version
+	request.PeerID = p.peerID()
 	request.Port = p.Port
-	call("Peer.AcceptConnect", &request, &reply, port)
+	if err := protocol.CallClient(ctx, s.client, s.Addr, protocol.PeerAcceptConnect, &request, &reply); err != nil {
+		fmt.Println(err)
+	}
 	if reply.Accepted == false {
-		fmt.Printf("Connection refused from Peer %v\n", id)
-		return
+		fmt.Printf("Connection refused from Peer %v\n", s.PeerID)
+		return false
 	}
-	p.peers[p.numPeers] = id
-	p.numPeers = p.numPeers + 1
-	fmt.Printf("Connected to Peer %v\n", id)
+	p.mu.Lock()
+	p.peers[s.PeerID] = true
+	p.mu.Unlock()
+	fmt.Printf("Connected to Peer %v\n", s.PeerID)
+	return true
 }
-
@@ -0,0 +1,166 @@
+/*
+	This file contains the Peer configuration and the functions used
+	to load it. Every setting can come from four places, in increasing
+	order of precedence:
+		1. built-in defaults
+		2. an optional JSON config file (-config or FS_CONFIG)
+		3. environment variables (FS_TRACKER, FS_LISTEN, FS_REPO, FS_ADVERTISE,
+		   FS_CA, FS_CERT, FS_KEY, FS_TOKEN)
+		4. command-line flags (-tracker, -listen, -repo, -advertise, -ca, -cert, -key, -token)
+*/
+
+package main
+
+import (
+	"crypto/x509"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/junvalentine/FileSharing/protocol"
+)
+
+/*
+	Settings used to start a Peer.
+*/
+type Config struct {
+	Tracker   string `json:"tracker"`
+	Listen    string `json:"listen"`
+	Repo      string `json:"repo"`
+	Advertise string `json:"advertise"`
+	CA        string `json:"ca"`
+	Cert      string `json:"cert"`
+	Key       string `json:"key"`
+	Token     string `json:"token"`
+	JSON      bool   `json:"-"`
+}
+
+/*
+	Returns the configuration used when nothing else is provided.
+*/
+func DefaultConfig() Config {
+	return Config{
+		Tracker: "127.0.0.1:1337",
+		Listen:  ":8080",
+		Repo:    "./",
+	}
+}
+
+/*
+	Builds the Peer configuration from the defaults, the config file,
+	the environment and the given command-line arguments. Returns
+	the arguments left after the flags: the command to run, if any.
+*/
+func LoadConfig(args []string) (Config, []string, error) {
+	conf := DefaultConfig()
+
+	fs := flag.NewFlagSet("peer", flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprint(fs.Output(), usage)
+		fs.PrintDefaults()
+	}
+	configFile := fs.String("config", os.Getenv("FS_CONFIG"), "path to a JSON config file")
+	tracker := fs.String("tracker", "", "address of the tracker (host:port)")
+	listen := fs.String("listen", "", "address or port the Peer listens on")
+	repo := fs.String("repo", "", "local repository directory")
+	advertise := fs.String("advertise", "", "host other Peers should dial (default: the address seen by the tracker)")
+	ca := fs.String("ca", "", "CA certificate; with -cert and -key, enables TLS")
+	cert := fs.String("cert", "", "certificate of this Peer, issued by the CA")
+	key := fs.String("key", "", "private key of the certificate")
+	token := fs.String("token", "", "join token (or shared secret) the tracker requires")
+	fs.BoolVar(&conf.JSON, "json", false, "print the result of a command as JSON")
+	if err := fs.Parse(args); err != nil {
+		return conf, nil, err
+	}
+
+	if *configFile != "" {
+		if err := conf.readFile(*configFile); err != nil {
+			return conf, nil, err
+		}
+	}
+
+	overrideString(&conf.Tracker, os.Getenv("FS_TRACKER"))
+	overrideString(&conf.Listen, os.Getenv("FS_LISTEN"))
+	overrideString(&conf.Repo, os.Getenv("FS_REPO"))
+	overrideString(&conf.Advertise, os.Getenv("FS_ADVERTISE"))
+	overrideString(&conf.CA, os.Getenv("FS_CA"))
+	overrideString(&conf.Cert, os.Getenv("FS_CERT"))
+	overrideString(&conf.Key, os.Getenv("FS_KEY"))
+	overrideString(&conf.Token, os.Getenv("FS_TOKEN"))
+
+	overrideString(&conf.Tracker, *tracker)
+	overrideString(&conf.Listen, *listen)
+	overrideString(&conf.Repo, *repo)
+	overrideString(&conf.Advertise, *advertise)
+	overrideString(&conf.CA, *ca)
+	overrideString(&conf.Cert, *cert)
+	overrideString(&conf.Key, *key)
+	overrideString(&conf.Token, *token)
+
+	conf.normalize()
+	if err := conf.loadTLS(); err != nil {
+		return conf, nil, err
+	}
+	return conf, fs.Args(), nil
+}
+
+/*
+	Reads a JSON config file on top of the current settings.
+	Fields missing from the file keep their current value.
+*/
+func (c *Config) readFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("reading config file: %v", err)
+	}
+	if err := json.Unmarshal(data, c); err != nil {
+		return fmt.Errorf("parsing config file %v: %v", path, err)
+	}
+	return nil
+}
+
+/*
+	Accepts a bare port for Listen and makes sure Repo ends with
+	a path separator, since file paths are built by concatenation.
+*/
+func (c *Config) normalize() {
+	if c.Listen != "" && !strings.Contains(c.Listen, ":") {
+		c.Listen = ":" + c.Listen
+	}
+	if c.Repo != "" && !strings.HasSuffix(c.Repo, "/") {
+		c.Repo = c.Repo + "/"
+	}
+}
+
+/*
+	Enables TLS when the CA, certificate and key are all set.
+*/
+func (c *Config) loadTLS() error {
+	if c.CA == "" && c.Cert == "" && c.Key == "" {
+		return nil
+	}
+	if c.CA == "" || c.Cert == "" || c.Key == "" {
+		return fmt.Errorf("TLS needs the CA, the certificate and the key")
+	}
+	conf, err := protocol.LoadTLS(c.CA, c.Cert, c.Key)
+	if err != nil {
+		return err
+	}
+	leaf, err := x509.ParseCertificate(conf.Certificates[0].Certificate[0])
+	if err != nil {
+		return fmt.Errorf("parsing %v: %v", c.Cert, err)
+	}
+	if name := leaf.Subject.CommonName; name == protocol.TrackerName {
+		return fmt.Errorf("%v is the Server's certificate, a Peer needs its own", c.Cert)
+	}
+	protocol.TLS = conf
+	return nil
+}
+
+func overrideString(dst *string, value string) {
+	if value != "" {
+		*dst = value
+	}
+}
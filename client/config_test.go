@@ -0,0 +1,56 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLoadConfig(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "peer.json")
+	other := filepath.Join(dir, "other.json")
+	os.WriteFile(file, []byte(`{"tracker": "file:1", "listen": "9000", "repo": "file-repo"}`), 0644)
+	os.WriteFile(other, []byte(`{"tracker": "other:1"}`), 0644)
+
+	cases := []struct {
+		name    string
+		env     map[string]string
+		args    []string
+		tracker string
+		listen  string
+		repo    string
+		rest    []string
+	}{
+		{"defaults", nil, nil, "127.0.0.1:1337", ":8080", "./", nil},
+		{"file over defaults", nil, []string{"-config", file}, "file:1", ":9000", "file-repo/", nil},
+		{"file from the environment", map[string]string{"FS_CONFIG": file}, nil, "file:1", ":9000", "file-repo/", nil},
+		{"-config over FS_CONFIG", map[string]string{"FS_CONFIG": file}, []string{"-config", other}, "other:1", ":8080", "./", nil},
+		{"environment over file", map[string]string{"FS_CONFIG": file, "FS_TRACKER": "env:1", "FS_LISTEN": "env:2"}, nil, "env:1", "env:2", "file-repo/", nil},
+		{"flags over environment", map[string]string{"FS_CONFIG": file, "FS_TRACKER": "env:1", "FS_LISTEN": "env:2"}, []string{"-tracker", "flag:1", "search", "x"}, "flag:1", "env:2", "file-repo/", []string{"search", "x"}},
+		{"flags over defaults", nil, []string{"-listen", "7000", "-repo", "r"}, "127.0.0.1:1337", ":7000", "r/", nil},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			for _, name := range []string{"FS_CONFIG", "FS_TRACKER", "FS_LISTEN", "FS_REPO", "FS_ADVERTISE", "FS_CA", "FS_CERT", "FS_KEY", "FS_TOKEN"} {
+				t.Setenv(name, c.env[name])
+			}
+			conf, rest, err := LoadConfig(c.args)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if conf.Tracker != c.tracker || conf.Listen != c.listen || conf.Repo != c.repo {
+				t.Errorf("got tracker %q, listen %q, repo %q, want %q, %q, %q", conf.Tracker, conf.Listen, conf.Repo, c.tracker, c.listen, c.repo)
+			}
+			if strings.Join(rest, " ") != strings.Join(c.rest, " ") {
+				t.Errorf("arguments left %q, want %q", rest, c.rest)
+			}
+		})
+	}
+
+	t.Setenv("FS_CONFIG", filepath.Join(dir, "missing.json"))
+	if _, _, err := LoadConfig(nil); err == nil {
+		t.Errorf("a missing config file was ignored")
+	}
+}
@@ -0,0 +1,522 @@
+/*
+	This file contains encrypted shares. The publisher encrypts a file
+	for the certificates of its recipients (see protocol/tls.go) and
+	registers the ciphertext, named with encryptedSuffix. Every other
+	Peer downloads, verifies and reseeds the ciphertext like any file,
+	but only the recipients, holding the matching private key, can
+	decrypt it, which fetch does on its own once the file is saved.
+
+	An encrypted file is made of a header:
+		"FSENC1\n"
+		the ephemeral P-256 public key of the file (65 bytes)
+		the number of recipients (uint16)
+		for each recipient: the length of its name (uint16), its name,
+		the ID of its key (16 bytes) and the wrapped file key (48 bytes)
+	followed by the contents, in segments of segmentSize bytes sealed
+	with AES-256-GCM. A random key encrypts the contents; it is wrapped
+	for each recipient with a key derived from ECDH between the
+	ephemeral key and the recipient's. Segments are numbered and the
+	last one is marked, so they cannot be reordered or cut off.
+
+	The names in the header only label the entries: nothing ties a
+	name to the key next to it, and Peers that are not recipients
+	cannot check the header at all, so they are never shown as who
+	the file is for.
+*/
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/junvalentine/FileSharing/protocol"
+)
+
+const encryptedMagic = "FSENC1\n"
+
+/*
+	Suffix of the name an encrypted share is registered under.
+	Recipients save the decrypted file without it.
+*/
+const encryptedSuffix = ".enc"
+
+const segmentSize = 64 * 1024
+const keyIDSize = 16
+const fileKeySize = 32
+
+/*
+	Returned when this Peer's key is not one the file was encrypted for.
+*/
+var errNotRecipient = errors.New("this Peer is not a recipient of the file")
+
+/*
+	A Peer a file is encrypted for: the name on its
+	certificate and its public key.
+*/
+type recipient struct {
+	name string
+	key  *ecdh.PublicKey
+}
+
+/*
+	Reads the certificate of a recipient. With TLS it must
+	have been issued by the CA.
+*/
+func loadRecipient(certFile string) (recipient, error) {
+	data, err := os.ReadFile(certFile)
+	if err != nil {
+		return recipient{}, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return recipient{}, fmt.Errorf("no certificate found in %v", certFile)
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return recipient{}, err
+	}
+	if protocol.TLS != nil {
+		if _, err := cert.Verify(x509.VerifyOptions{Roots: protocol.TLS.RootCAs, KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageAny}}); err != nil {
+			return recipient{}, fmt.Errorf("%v: %v", certFile, err)
+		}
+	}
+	return certRecipient(cert)
+}
+
+func certRecipient(cert *x509.Certificate) (recipient, error) {
+	pub, ok := cert.PublicKey.(*ecdsa.PublicKey)
+	if !ok {
+		return recipient{}, fmt.Errorf("the certificate of %v has no ECDSA key", cert.Subject.CommonName)
+	}
+	key, err := pub.ECDH()
+	if err != nil {
+		return recipient{}, err
+	}
+	return recipient{cert.Subject.CommonName, key}, nil
+}
+
+/*
+	Returns this Peer's own certificate and key, those it
+	uses for TLS (see -cert and -key).
+*/
+func ownKey() (recipient, *ecdh.PrivateKey, error) {
+	if protocol.TLS == nil {
+		return recipient{}, nil, fmt.Errorf("encrypted shares need this Peer's certificate and key, see -cert and -key")
+	}
+	pair := protocol.TLS.Certificates[0]
+	cert, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return recipient{}, nil, err
+	}
+	self, err := certRecipient(cert)
+	if err != nil {
+		return recipient{}, nil, err
+	}
+	priv, ok := pair.PrivateKey.(*ecdsa.PrivateKey)
+	if !ok {
+		return recipient{}, nil, fmt.Errorf("this Peer's key is not an ECDSA key")
+	}
+	key, err := priv.ECDH()
+	if err != nil {
+		return recipient{}, nil, err
+	}
+	return self, key, nil
+}
+
+func keyID(key *ecdh.PublicKey) []byte {
+	sum := sha256.Sum256(key.Bytes())
+	return sum[:keyIDSize]
+}
+
+/*
+	Derives the key wrapping the file key for one recipient
+	from their ECDH shared secret, with HKDF-SHA256.
+*/
+func wrapKey(shared []byte, ephemeral *ecdh.PublicKey, recipient *ecdh.PublicKey) []byte {
+	salt := append(append([]byte{}, ephemeral.Bytes()...), recipient.Bytes()...)
+	extract := hmac.New(sha256.New, salt)
+	extract.Write(shared)
+	expand := hmac.New(sha256.New, extract.Sum(nil))
+	expand.Write([]byte("FileSharing file key\x01"))
+	return expand.Sum(nil)
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+/*
+	Returns the nonce of the n-th segment of the contents.
+*/
+func segmentNonce(n uint64, last bool) []byte {
+	nonce := make([]byte, 12)
+	binary.BigEndian.PutUint64(nonce, n)
+	if last {
+		nonce[11] = 1
+	}
+	return nonce
+}
+
+/*
+	Encrypts the file at srcPath for the recipients into dstPath.
+	dstPath is only replaced once it is complete.
+*/
+func encryptFile(srcPath string, dstPath string, recipients []recipient) error {
+	if len(recipients) == 0 {
+		return fmt.Errorf("no recipients")
+	}
+	ephemeral, err := ecdh.P256().GenerateKey(rand.Reader)
+	if err != nil {
+		return err
+	}
+	fileKey := make([]byte, fileKeySize)
+	if _, err := rand.Read(fileKey); err != nil {
+		return err
+	}
+
+	header := bytes.Buffer{}
+	header.WriteString(encryptedMagic)
+	header.Write(ephemeral.PublicKey().Bytes())
+	binary.Write(&header, binary.BigEndian, uint16(len(recipients)))
+	for _, r := range recipients {
+		shared, err := ephemeral.ECDH(r.key)
+		if err != nil {
+			return err
+		}
+		aead, err := newGCM(wrapKey(shared, ephemeral.PublicKey(), r.key))
+		if err != nil {
+			return err
+		}
+		binary.Write(&header, binary.BigEndian, uint16(len(r.name)))
+		header.WriteString(r.name)
+		header.Write(keyID(r.key))
+		// Each wrapping key is used once, so a fixed nonce is safe.
+		header.Write(aead.Seal(nil, make([]byte, aead.NonceSize()), fileKey, keyID(r.key)))
+	}
+
+	src, err := os.Open(srcPath)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	tmp := dstPath + ".tmp"
+	dst, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp)
+
+	err = sealContents(bufio.NewReader(src), dst, header.Bytes(), fileKey)
+	if cerr := dst.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, dstPath)
+}
+
+/*
+	Writes the header, then the contents read from src in sealed
+	segments, bound to the header.
+*/
+func sealContents(src *bufio.Reader, dst io.Writer, header []byte, fileKey []byte) error {
+	aead, err := newGCM(fileKey)
+	if err != nil {
+		return err
+	}
+	if _, err := dst.Write(header); err != nil {
+		return err
+	}
+	ad := sha256.Sum256(header)
+	buf := make([]byte, segmentSize)
+	for n := uint64(0); ; n++ {
+		size, err := io.ReadFull(src, buf)
+		if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+			return err
+		}
+		_, peekErr := src.Peek(1)
+		last := err != nil || peekErr == io.EOF
+		if _, err := dst.Write(aead.Seal(nil, segmentNonce(n, last), buf[:size], ad[:])); err != nil {
+			return err
+		}
+		if last {
+			return nil
+		}
+	}
+}
+
+/*
+	The header of an encrypted file.
+*/
+type encryptedHeader struct {
+	raw       []byte
+	ephemeral *ecdh.PublicKey
+	names     []string
+	keyIDs    [][]byte
+	wrapped   [][]byte
+}
+
+/*
+	Reads the header of an encrypted file. Returns
+	nil without an error if r is not one.
+*/
+func readHeader(r *bufio.Reader) (*encryptedHeader, error) {
+	magic, err := r.Peek(len(encryptedMagic))
+	if err != nil || string(magic) != encryptedMagic {
+		return nil, nil
+	}
+	raw := bytes.Buffer{}
+	tee := io.TeeReader(r, &raw)
+	invalid := func(err error) (*encryptedHeader, error) {
+		return nil, fmt.Errorf("invalid encrypted file: %v", err)
+	}
+
+	fixed := make([]byte, len(encryptedMagic)+65+2)
+	if _, err := io.ReadFull(tee, fixed); err != nil {
+		return invalid(err)
+	}
+	ephemeral, err := ecdh.P256().NewPublicKey(fixed[len(encryptedMagic) : len(encryptedMagic)+65])
+	if err != nil {
+		return invalid(err)
+	}
+	h := &encryptedHeader{ephemeral: ephemeral}
+	count := binary.BigEndian.Uint16(fixed[len(fixed)-2:])
+	for i := 0; i < int(count); i++ {
+		var nameLen uint16
+		if err := binary.Read(tee, binary.BigEndian, &nameLen); err != nil {
+			return invalid(err)
+		}
+		entry := make([]byte, int(nameLen)+keyIDSize+fileKeySize+16)
+		if _, err := io.ReadFull(tee, entry); err != nil {
+			return invalid(err)
+		}
+		h.names = append(h.names, string(entry[:nameLen]))
+		h.keyIDs = append(h.keyIDs, entry[nameLen:int(nameLen)+keyIDSize])
+		h.wrapped = append(h.wrapped, entry[int(nameLen)+keyIDSize:])
+	}
+	h.raw = raw.Bytes()
+	return h, nil
+}
+
+/*
+	Returns true if the file at filePath is an encrypted share.
+*/
+func isEncrypted(filePath string) bool {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	h, err := readHeader(bufio.NewReader(f))
+	return h != nil && err == nil
+}
+
+/*
+	Returns true if the file at filePath is the plaintext of an
+	encrypted share next to it, as decrypted by fetch or encrypted
+	by publish (see plainName()). Such files are not published with
+	their directory, which would share them in clear.
+*/
+func isPlainCopy(filePath string) bool {
+	if isEncrypted(filePath + encryptedSuffix) {
+		return true
+	}
+	share := strings.TrimSuffix(filePath, ".plain")
+	return share != filePath && isEncrypted(share)
+}
+
+/*
+	Decrypts the file at srcPath into dstPath with this Peer's key.
+	Fails with errNotRecipient if the file was not encrypted for it,
+	and if the contents were altered, without writing dstPath.
+*/
+func decryptFile(srcPath string, dstPath string) error {
+	self, key, err := ownKey()
+	if err != nil {
+		return err
+	}
+	src, err := os.Open(srcPath)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	r := bufio.NewReader(src)
+	h, err := readHeader(r)
+	if err != nil {
+		return err
+	}
+	if h == nil {
+		return fmt.Errorf("%v is not encrypted", srcPath)
+	}
+
+	var fileKey []byte
+	for i := range h.keyIDs {
+		if !bytes.Equal(h.keyIDs[i], keyID(self.key)) {
+			continue
+		}
+		shared, err := key.ECDH(h.ephemeral)
+		if err != nil {
+			return err
+		}
+		aead, err := newGCM(wrapKey(shared, h.ephemeral, self.key))
+		if err != nil {
+			return err
+		}
+		if fileKey, err = aead.Open(nil, make([]byte, aead.NonceSize()), h.wrapped[i], h.keyIDs[i]); err != nil {
+			return fmt.Errorf("unwrapping the file key: %v", err)
+		}
+		break
+	}
+	if fileKey == nil {
+		return errNotRecipient
+	}
+
+	tmp := dstPath + ".tmp"
+	dst, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp)
+	err = openContents(r, dst, h.raw, fileKey)
+	if cerr := dst.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, dstPath)
+}
+
+/*
+	Reads the sealed segments following the header from src
+	and writes the contents to dst.
+*/
+func openContents(src *bufio.Reader, dst io.Writer, header []byte, fileKey []byte) error {
+	aead, err := newGCM(fileKey)
+	if err != nil {
+		return err
+	}
+	ad := sha256.Sum256(header)
+	buf := make([]byte, segmentSize+aead.Overhead())
+	for n := uint64(0); ; n++ {
+		size, err := io.ReadFull(src, buf)
+		if err == io.EOF {
+			return fmt.Errorf("the encrypted file is truncated")
+		}
+		if err != nil && err != io.ErrUnexpectedEOF {
+			return err
+		}
+		_, peekErr := src.Peek(1)
+		last := err != nil || peekErr == io.EOF
+		plain, err := aead.Open(nil, segmentNonce(n, last), buf[:size], ad[:])
+		if err != nil {
+			return fmt.Errorf("the encrypted file was altered or truncated")
+		}
+		if _, err := dst.Write(plain); err != nil {
+			return err
+		}
+		if last {
+			return nil
+		}
+	}
+}
+
+/*
+	Returns the name a share registered as name is decrypted to.
+*/
+func plainName(name string) string {
+	if plain := strings.TrimSuffix(name, encryptedSuffix); plain != name && plain != "" {
+		return plain
+	}
+	return name + ".plain"
+}
+
+/*
+	Encrypts the file at filePath for the Peers whose certificates
+	are in certFiles, and this Peer, into the repository as the
+	file's name with encryptedSuffix. Returns that name.
+*/
+func (p *Peer) encryptShare(filePath string, certFiles []string) (string, error) {
+	self, _, err := ownKey()
+	if err != nil {
+		return "", err
+	}
+	recipients := []recipient{self}
+	for _, certFile := range certFiles {
+		r, err := loadRecipient(certFile)
+		if err != nil {
+			return "", err
+		}
+		recipients = append(recipients, r)
+	}
+
+	name := filepath.Base(filePath) + encryptedSuffix
+	dstPath, err := savePath(p.directory, name)
+	if err != nil {
+		return "", err
+	}
+	if err := encryptFile(filePath, dstPath, recipients); err != nil {
+		return "", err
+	}
+	fmt.Printf("Encrypted %v for %v recipients into %v\n", filePath, len(recipients), dstPath)
+	return name, nil
+}
+
+/*
+	Decrypts a share downloaded to filePath, into root under its
+	name without encryptedSuffix, see decryptFetched().
+*/
+func decryptInRoot(info *protocol.FileInfo, filePath string, root string) (string, error) {
+	if !info.Encrypted {
+		return "", nil
+	}
+	plainPath, err := savePath(root, plainName(info.Name))
+	if err != nil {
+		return "", err
+	}
+	return decryptFetched(info, filePath, plainPath)
+}
+
+/*
+	Decrypts an encrypted share once it was downloaded to filePath,
+	into plainPath. A Peer that is not a recipient keeps the
+	encrypted copy, which it can still reseed. Returns the path of
+	the decrypted file, or "" if it was not decrypted.
+*/
+func decryptFetched(info *protocol.FileInfo, filePath string, plainPath string) (string, error) {
+	if !info.Encrypted {
+		return "", nil
+	}
+	err := decryptFile(filePath, plainPath)
+	if errors.Is(err, errNotRecipient) {
+		fmt.Printf("%v is encrypted and this Peer is not a recipient, keeping the encrypted copy\n", info.Name)
+		return "", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("decrypting %v: %v", info.Name, err)
+	}
+	fmt.Printf("Decrypted %v into %v\n", info.Name, plainPath)
+	return plainPath, nil
+}
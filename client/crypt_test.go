@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/junvalentine/FileSharing/protocol"
+)
+
+/*
+	Issues certificates for names with a new CA and
+	returns the directory they are in.
+*/
+func makeCerts(t *testing.T, names ...string) string {
+	t.Helper()
+	dir := t.TempDir()
+	if err := protocol.NewCA(filepath.Join(dir, "ca")); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range names {
+		if _, err := protocol.IssueCert(filepath.Join(dir, "ca"), name, nil, dir); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+/*
+	Makes this process use the certificate and key of name.
+*/
+func useCert(t *testing.T, dir string, name string) {
+	t.Helper()
+	conf, err := protocol.LoadTLS(filepath.Join(dir, protocol.CACertFile), filepath.Join(dir, name+".crt"), filepath.Join(dir, name+".key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	protocol.TLS = conf
+	t.Cleanup(func() { protocol.TLS = nil })
+}
+
+func TestEncryptedShare(t *testing.T) {
+	certs := makeCerts(t, "alice", "bob", "eve")
+	dir := t.TempDir()
+	for _, size := range []int{0, 10, segmentSize, 3*segmentSize + 7} {
+		plain := make([]byte, size)
+		rand.Read(plain)
+		src := filepath.Join(dir, "plain")
+		enc := filepath.Join(dir, "plain.enc")
+		if err := os.WriteFile(src, plain, 0644); err != nil {
+			t.Fatal(err)
+		}
+		bob, err := loadRecipient(filepath.Join(certs, "bob.crt"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		useCert(t, certs, "alice")
+		alice, _, err := ownKey()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := encryptFile(src, enc, []recipient{alice, bob}); err != nil {
+			t.Fatal(err)
+		}
+		if !isEncrypted(enc) || isEncrypted(src) {
+			t.Errorf("isEncrypted(%v) = %v, isEncrypted(%v) = %v", enc, isEncrypted(enc), src, isEncrypted(src))
+		}
+		data, _ := os.ReadFile(enc)
+		if size > 0 && bytes.Contains(data, plain) {
+			t.Errorf("the encrypted file contains the plaintext")
+		}
+
+		for _, name := range []string{"alice", "bob"} {
+			useCert(t, certs, name)
+			out := filepath.Join(dir, name)
+			if err := decryptFile(enc, out); err != nil {
+				t.Fatalf("%v decrypting %v bytes: %v", name, size, err)
+			}
+			if got, _ := os.ReadFile(out); !bytes.Equal(got, plain) {
+				t.Errorf("%v decrypted %v bytes, want %v", name, len(got), size)
+			}
+		}
+
+		useCert(t, certs, "eve")
+		if err := decryptFile(enc, filepath.Join(dir, "eve")); !errors.Is(err, errNotRecipient) {
+			t.Errorf("eve decrypting: %v, want errNotRecipient", err)
+		}
+
+		// Altered or truncated files, or a relabeled header,
+		// are rejected, and nothing is written.
+		useCert(t, certs, "bob")
+		altered := append([]byte{}, data...)
+		altered[len(altered)-1] ^= 1
+		relabeled := bytes.Replace(data, []byte("bob"), []byte("eve"), 1)
+		// Cut off the whole last segment.
+		lastSize := size % segmentSize
+		if lastSize == 0 && size > 0 {
+			lastSize = segmentSize
+		}
+		truncated := data[:len(data)-lastSize-16]
+		for _, bad := range [][]byte{altered, truncated, relabeled} {
+			os.WriteFile(enc, bad, 0644)
+			out := filepath.Join(dir, "bad")
+			if err := decryptFile(enc, out); err == nil {
+				t.Errorf("decrypting an altered file of %v bytes succeeded", size)
+			}
+			if _, err := os.Stat(out); err == nil {
+				t.Errorf("decrypting an altered file wrote %v", out)
+			}
+		}
+	}
+}
+
+func TestPlainCopy(t *testing.T) {
+	certs := makeCerts(t, "alice")
+	useCert(t, certs, "alice")
+	alice, _, err := ownKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	files := []string{"plan.txt", "notes.txt", "report", "report.plain", "other.plain"}
+	for _, name := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, share := range []string{"plan.txt", "report"} {
+		if err := encryptFile(filepath.Join(dir, share), filepath.Join(dir, share+".enc"), []recipient{alice}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// A share named without the suffix is decrypted to ".plain".
+	os.Rename(filepath.Join(dir, "report.enc"), filepath.Join(dir, "report"))
+	// Not encrypted, so other.plain is an ordinary file.
+	os.WriteFile(filepath.Join(dir, "other"), []byte("other"), 0644)
+	os.WriteFile(filepath.Join(dir, "notes.txt.enc"), []byte("not encrypted"), 0644)
+
+	want := map[string]bool{"plan.txt": true, "plan.txt.enc": false, "notes.txt": false, "report": false, "report.plain": true, "other.plain": false}
+	for name, plain := range want {
+		if got := isPlainCopy(filepath.Join(dir, name)); got != plain {
+			t.Errorf("isPlainCopy(%v) = %v, want %v", name, got, plain)
+		}
+	}
+}
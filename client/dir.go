@@ -0,0 +1,145 @@
+/*
+	This file contains how a Peer shares whole directories. Each file
+	in a published directory is registered on its own, named by its
+	path relative to the directory the published one is in, e.g.
+	"project/src/main.go". Fetching "project" downloads every file
+	under it and recreates the same tree.
+*/
+
+package main
+
+import (
+	"fmt"
+	"io/fs"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/junvalentine/FileSharing/protocol"
+)
+
+/*
+	Returns true for files that are never published from a
+	directory: the repository's own files and partial downloads.
+*/
+func skipPublish(name string) bool {
+	base := path.Base(name)
+	return base == identityFile || base == publishedFile || strings.HasSuffix(base, ".part") || strings.HasSuffix(base, ".part.state")
+}
+
+/*
+	Registers every regular file under location+dirName, with
+	the given description, tags and access list, except the
+	plaintext copies of encrypted shares. Returns the names
+	registered.
+*/
+func (p *Peer) PublishDir(dirName string, location string, description string, tags []string, access []string) ([]string, error) {
+	dirName = path.Clean(filepath.ToSlash(dirName))
+	root := filepath.Join(location, filepath.FromSlash(dirName))
+
+	names := []string{}
+	err := filepath.WalkDir(root, func(filePath string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		rel, err := filepath.Rel(root, filePath)
+		if err != nil {
+			return err
+		}
+		name := path.Join(dirName, filepath.ToSlash(rel))
+		if isPlainCopy(filePath) {
+			fmt.Printf("Not publishing %v, it is the plaintext of an encrypted share\n", name)
+		} else if !skipPublish(name) {
+			names = append(names, name)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(names) == 0 {
+		return nil, fmt.Errorf("%v has no files to publish", dirName)
+	}
+
+	for _, name := range names {
+		if err := p.RegisterFile(name, location, description, tags, access); err != nil {
+			return nil, fmt.Errorf("registering %v: %v", name, err)
+		}
+	}
+	fmt.Printf("Registered %v files from %v\n", len(names), dirName)
+	return names, nil
+}
+
+/*
+	Downloads every file of a directory found by the Server into
+	root, recreating its tree. When a name is held with different
+	contents, the copy most Peers hold is downloaded. If register
+	is true, root is the repository and the files are published
+	once downloaded. Encrypted shares are decrypted next to their
+	encrypted copy if this Peer is a recipient. Returns the files saved and the names that
+	could not be downloaded.
+*/
+func (p *Peer) fetchDir(reply *protocol.FindPeerReply, root string, register bool) ([]fetchResult, []string) {
+	byName := map[string][]int{}
+	for i, info := range reply.Info {
+		byName[info.Name] = append(byName[info.Name], i)
+	}
+	names := make([]string, 0, len(byName))
+	for name := range byName {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	fmt.Printf("Fetching %v files of %v\n", len(names), reply.File)
+
+	saved := []fetchResult{}
+	failed := []string{}
+	for _, name := range names {
+		// Pick the content most holders have, then only keep them.
+		holders := map[string]int{}
+		target := reply.Info[byName[name][0]]
+		for _, i := range byName[name] {
+			holders[reply.Info[i].Hash]++
+			if holders[reply.Info[i].Hash] > holders[target.Hash] {
+				target = reply.Info[i]
+			}
+		}
+		sub := protocol.FindPeerReply{File: name, Found: true}
+		for _, i := range byName[name] {
+			if reply.Info[i].Hash == target.Hash {
+				sub.PeerID = append(sub.PeerID, reply.PeerID[i])
+				sub.Addr = append(sub.Addr, reply.Addr[i])
+				sub.Names = append(sub.Names, reply.HolderName(i))
+				sub.Info = append(sub.Info, reply.Info[i])
+			}
+		}
+
+		// The names come from the Server: savePath() keeps them in root.
+		filePath, err := savePath(root, name)
+		if err != nil {
+			fmt.Printf("Not saving %v: %v\n", name, err)
+			failed = append(failed, name)
+			continue
+		}
+		served, ok := p.SwarmDownload(&sub, &target, filePath)
+		if !ok {
+			failed = append(failed, name)
+			continue
+		}
+		if register {
+			if err := p.RegisterFile(name, p.directory, target.Description, target.Tags, target.Access); err != nil {
+				fmt.Printf("Error registering file %v: %v\n", name, err)
+			}
+		}
+		plainPath, err := decryptInRoot(&target, filePath, root)
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+		}
+		saved = append(saved, fetchResult{name, filePath, target.Size, target.Hash, served, plainPath})
+	}
+	fmt.Printf("Fetched %v/%v files of %v\n", len(saved), len(names), reply.File)
+	return saved, failed
+}
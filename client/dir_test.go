@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/junvalentine/FileSharing/protocol"
+)
+
+func TestPublishAndFetchDir(t *testing.T) {
+	repo := t.TempDir()
+	files := map[string]string{
+		"project/readme.md":           "readme",
+		"project/src/main.go":         "package main",
+		"project/src/deep/data.bin":   "data",
+		"project/plan.txt":            "the plan",
+		"project/.peer-id":            "id",
+		"project/src/.published.json": "[]",
+		"project/src/get.bin.part":    "partial",
+		"other/outside.txt":           "not in project",
+	}
+	for name, data := range files {
+		filePath := filepath.Join(repo, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(filePath), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filePath, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// plan.txt is the plaintext of plan.txt.enc.
+	useCert(t, makeCerts(t, "alice"), "alice")
+	alice, _, err := ownKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	plan := filepath.Join(repo, "project", "plan.txt")
+	if err := encryptFile(plan, plan+encryptedSuffix, []recipient{alice}); err != nil {
+		t.Fatal(err)
+	}
+	protocol.TLS = nil
+
+	p := &Peer{PeerID: 1, directory: repo + "/", files: map[string]*sharedFile{}, unpublished: map[string]bool{}, uploads: map[int]time.Time{}, peers: map[int]bool{}}
+	tracker := startTracker(t, p, true)
+	names, err := p.PublishDir("project/", repo+"/", "the project", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"project/plan.txt.enc", "project/readme.md", "project/src/deep/data.bin", "project/src/main.go"}
+	sort.Strings(names)
+	sort.Strings(tracker.registered)
+	if !reflect.DeepEqual(names, want) || !reflect.DeepEqual(tracker.registered, want) {
+		t.Fatalf("published %q, registered %q, want %q", names, tracker.registered, want)
+	}
+
+	// Another Peer fetches the directory into a fresh repository.
+	if err := p.peerServer("127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+	defer p.listener.Close()
+	reply := protocol.FindPeerReply{File: "project", Found: true, Dir: true}
+	for _, name := range names {
+		reply.PeerID = append(reply.PeerID, p.PeerID)
+		reply.Addr = append(reply.Addr, p.listener.Addr().String())
+		reply.Info = append(reply.Info, p.files[name].Info)
+	}
+	fresh := t.TempDir()
+	q := downloadPeer()
+	q.directory = fresh + "/"
+	saved, failed := q.fetchDir(&reply, fresh, false)
+	if len(saved) != len(want) || len(failed) != 0 {
+		t.Fatalf("saved %+v, failed %v", saved, failed)
+	}
+	for _, name := range want {
+		got, err := os.ReadFile(filepath.Join(fresh, filepath.FromSlash(name)))
+		if err != nil {
+			t.Errorf("%v was not saved: %v", name, err)
+			continue
+		}
+		original, _ := os.ReadFile(filepath.Join(repo, filepath.FromSlash(name)))
+		if !bytes.Equal(got, original) {
+			t.Errorf("%v differs from the published file", name)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(fresh, "project", "plan.txt")); err == nil {
+		t.Errorf("the plaintext of plan.txt.enc was fetched")
+	}
+}
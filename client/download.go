@@ -0,0 +1,106 @@
+/*
+	This file contains the bookkeeping for partial downloads.
+	While a file is being fetched its contents are written to
+	"<name>.part" and a sidecar "<name>.part.state" records which
+	chunks are already on disk, so that a later fetch of the same
+	file (even after the client restarted) resumes where it stopped.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"os"
+
+	"github.com/junvalentine/FileSharing/protocol"
+)
+
+/*
+	Progress of a partial download, as stored in the sidecar file.
+*/
+type downloadState struct {
+	File      string
+	Size      int64
+	Hash      string
+	ChunkSize int
+	Done      []bool
+	path      string
+}
+
+/*
+	Returns the number of chunks a file of the given size is split into.
+*/
+func numChunks(size int64) int {
+	return int((size + protocol.ChunkSize - 1) / protocol.ChunkSize)
+}
+
+func partPath(filePath string) string {
+	return filePath + ".part"
+}
+
+func statePath(filePath string) string {
+	return filePath + ".part.state"
+}
+
+/*
+	Loads the state of a previous download of filePath. If there is
+	none, or it was made for different contents or chunk size, a fresh
+	state is returned and resumed is false.
+*/
+func loadDownloadState(filePath string, target *protocol.FileInfo) (state *downloadState, resumed bool) {
+	state = &downloadState{path: statePath(filePath)}
+
+	data, err := os.ReadFile(state.path)
+	if err == nil && json.Unmarshal(data, state) == nil &&
+		state.Size == target.Size && state.Hash == target.Hash &&
+		state.ChunkSize == protocol.ChunkSize &&
+		len(state.Done) == numChunks(target.Size) {
+		if _, err := os.Stat(partPath(filePath)); err == nil {
+			return state, true
+		}
+	}
+
+	state.File = target.Name
+	state.Size = target.Size
+	state.Hash = target.Hash
+	state.ChunkSize = protocol.ChunkSize
+	state.Done = make([]bool, numChunks(target.Size))
+	return state, false
+}
+
+/*
+	Returns the number of chunks already on disk.
+*/
+func (s *downloadState) completed() int {
+	n := 0
+	for _, done := range s.Done {
+		if done {
+			n++
+		}
+	}
+	return n
+}
+
+/*
+	Writes the state to its sidecar file. The state is written to a
+	temporary file first and renamed, so a crash never leaves a
+	half-written sidecar behind.
+*/
+func (s *downloadState) save() error {
+	data, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
+
+/*
+	Deletes the sidecar file once the download is complete.
+*/
+func (s *downloadState) remove() {
+	os.Remove(s.path)
+}
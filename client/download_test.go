@@ -0,0 +1,220 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/junvalentine/FileSharing/protocol"
+)
+
+/*
+	Writes a file of n chunks, the last one shorter, to dir
+	and returns its metadata.
+*/
+func makeChunkedFile(t *testing.T, dir string, name string, n int) protocol.FileInfo {
+	t.Helper()
+	data := bytes.Repeat([]byte("0123456789abcdef"), (n*protocol.ChunkSize-100)/16)
+	for i := range data {
+		data[i] += byte(i / protocol.ChunkSize)
+	}
+	filePath := filepath.Join(dir, name)
+	if err := os.WriteFile(filePath, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	info, err := describeFile(filePath, name, "", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return info
+}
+
+/*
+	Starts a Peer with the given PeerID sharing the
+	given file of repo.
+*/
+func startSharing(t *testing.T, peerID int, repo string, info protocol.FileInfo) *Peer {
+	t.Helper()
+	p := &Peer{PeerID: peerID, directory: repo + "/", files: map[string]*sharedFile{}, uploads: map[int]time.Time{}, peers: map[int]bool{}}
+	p.files[info.Name] = &sharedFile{Location: repo + "/", Info: info}
+	if err := p.peerServer("127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { p.listener.Close() })
+	return p
+}
+
+/*
+	Starts a Peer with the given PeerID sharing the given
+	file of repo and returns its address.
+*/
+func sharePeer(t *testing.T, peerID int, repo string, info protocol.FileInfo) string {
+	t.Helper()
+	return startSharing(t, peerID, repo, info).listener.Addr().String()
+}
+
+/*
+	Starts a Peer sharing the given file of repo and
+	returns a source downloading from it.
+*/
+func serveFile(t *testing.T, repo string, info protocol.FileInfo) *swarmSource {
+	t.Helper()
+	addr := sharePeer(t, 1, repo, info)
+	c, err := protocol.Dial(context.Background(), addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return &swarmSource{PeerID: 1, Addr: addr, client: c}
+}
+
+func TestLoadDownloadState(t *testing.T) {
+	dir := t.TempDir()
+	target := protocol.FileInfo{Name: "f.bin", Size: 3*protocol.ChunkSize - 10, Hash: "aaaa"}
+	filePath := filepath.Join(dir, target.Name)
+	valid := downloadState{File: target.Name, Size: target.Size, Hash: target.Hash, ChunkSize: protocol.ChunkSize, Done: []bool{true, false, true}}
+
+	cases := []struct {
+		name    string
+		state   func() []byte
+		part    bool
+		resumed bool
+	}{
+		{"resume", func() []byte { return mustJSON(t, valid) }, true, true},
+		{"no state", nil, true, false},
+		{"no part", func() []byte { return mustJSON(t, valid) }, false, false},
+		{"corrupt state", func() []byte { return []byte(`{"Size": 3`) }, true, false},
+		{"other contents", func() []byte {
+			s := valid
+			s.Hash = "bbbb"
+			return mustJSON(t, s)
+		}, true, false},
+		{"other size", func() []byte {
+			s := valid
+			s.Size++
+			return mustJSON(t, s)
+		}, true, false},
+		{"other chunk size", func() []byte {
+			s := valid
+			s.ChunkSize = protocol.ChunkSize / 2
+			return mustJSON(t, s)
+		}, true, false},
+		{"wrong chunk count", func() []byte {
+			s := valid
+			s.Done = []bool{true, true}
+			return mustJSON(t, s)
+		}, true, false},
+	}
+	for _, c := range cases {
+		os.Remove(statePath(filePath))
+		os.Remove(partPath(filePath))
+		if c.state != nil {
+			if err := os.WriteFile(statePath(filePath), c.state(), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if c.part {
+			if err := os.WriteFile(partPath(filePath), nil, 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		state, resumed := loadDownloadState(filePath, &target)
+		if resumed != c.resumed {
+			t.Errorf("%v: resumed %v, want %v", c.name, resumed, c.resumed)
+		}
+		want := 0
+		if c.resumed {
+			want = 2
+		}
+		if state.completed() != want || len(state.Done) != 3 || state.Hash != target.Hash || state.ChunkSize != protocol.ChunkSize {
+			t.Errorf("%v: got %+v", c.name, state)
+		}
+	}
+}
+
+func mustJSON(t *testing.T, s downloadState) []byte {
+	t.Helper()
+	s.path = ""
+	data, err := json.Marshal(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestResumeDownload(t *testing.T) {
+	repo, _ := makeRepo(t)
+	target := makeChunkedFile(t, repo, "big.bin", 3)
+	source := serveFile(t, repo, target)
+	data, err := os.ReadFile(filepath.Join(repo, target.Name))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// An earlier fetch stopped after the first chunk.
+	filePath := filepath.Join(t.TempDir(), target.Name)
+	if err := os.WriteFile(partPath(filePath), data[:protocol.ChunkSize], 0644); err != nil {
+		t.Fatal(err)
+	}
+	state, _ := loadDownloadState(filePath, &target)
+	state.Done[0] = true
+	if err := state.save(); err != nil {
+		t.Fatal(err)
+	}
+
+	if !saveFile([]*swarmSource{source}, nil, &target, 2, filePath) {
+		t.Fatal("saveFile failed")
+	}
+	if source.served != 2 {
+		t.Errorf("fetched %v chunks, want 2", source.served)
+	}
+	got, err := os.ReadFile(filePath)
+	if err != nil || !bytes.Equal(got, data) {
+		t.Errorf("saved file differs: %v", err)
+	}
+	for _, leftover := range []string{partPath(filePath), statePath(filePath)} {
+		if _, err := os.Stat(leftover); err == nil {
+			t.Errorf("%v was not removed", leftover)
+		}
+	}
+}
+
+func TestRefetchCorruptChunks(t *testing.T) {
+	repo, _ := makeRepo(t)
+	target := makeChunkedFile(t, repo, "big.bin", 3)
+	source := serveFile(t, repo, target)
+	data, err := os.ReadFile(filepath.Join(repo, target.Name))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The state says two chunks are on disk, but the second was damaged.
+	filePath := filepath.Join(t.TempDir(), target.Name)
+	part := append([]byte{}, data[:2*protocol.ChunkSize]...)
+	part[protocol.ChunkSize+5] ^= 0xff
+	if err := os.WriteFile(partPath(filePath), part, 0644); err != nil {
+		t.Fatal(err)
+	}
+	state, _ := loadDownloadState(filePath, &target)
+	state.Done[0] = true
+	state.Done[1] = true
+	if err := state.save(); err != nil {
+		t.Fatal(err)
+	}
+
+	if !saveFile([]*swarmSource{source}, nil, &target, 2, filePath) {
+		t.Fatal("saveFile failed")
+	}
+	if source.served != 2 {
+		t.Errorf("fetched %v chunks, want 2", source.served)
+	}
+	got, err := os.ReadFile(filePath)
+	if err != nil || !bytes.Equal(got, data) {
+		t.Errorf("saved file differs: %v", err)
+	}
+}
@@ -1,3 +0,0 @@
-module client
-
-go 1.21.4
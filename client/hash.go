@@ -0,0 +1,54 @@
+/*
+	This file contains the content hashing used to verify transfers.
+	Every registered file is described by the SHA-256 of its whole
+	contents and the SHA-256 of each ChunkSize block, all hex encoded.
+*/
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"os"
+
+	"github.com/junvalentine/FileSharing/protocol"
+)
+
+/*
+	Returns the SHA-256 of a chunk of data.
+*/
+func hashChunk(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+/*
+	Reads a file once and returns the SHA-256 of its contents
+	and of each of its chunks.
+*/
+func hashFile(filePath string) (string, []string, error) {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return "", nil, err
+	}
+	defer f.Close()
+
+	whole := sha256.New()
+	chunks := []string{}
+	buf := make([]byte, protocol.ChunkSize)
+	for {
+		n, err := io.ReadFull(f, buf)
+		if n > 0 {
+			whole.Write(buf[:n])
+			chunks = append(chunks, hashChunk(buf[:n]))
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return "", nil, err
+		}
+	}
+	return hex.EncodeToString(whole.Sum(nil)), chunks, nil
+}
@@ -0,0 +1,48 @@
+/*
+	This file contains the heartbeats a Peer sends to keep its
+	lease on the Server. The Server stops returning the Peer's
+	files once the lease runs out. If the Server no longer knows
+	the Peer, the Peer connects again and republishes its files.
+*/
+
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/junvalentine/FileSharing/protocol"
+)
+
+/*
+	Renews the Peer's lease three times per lease period,
+	until the Peer shuts down.
+*/
+func (p *Peer) sendHeartbeats() {
+	for {
+		interval := p.leaseTime() / 3
+		if interval <= 0 {
+			interval = 10 * time.Second
+		}
+		time.Sleep(interval)
+		if p.isClosing() {
+			return
+		}
+
+		request := protocol.HeartbeatArgs{}
+		reply := protocol.HeartbeatReply{}
+		request.PeerID = p.peerID()
+		if err := p.serverCall(protocol.ServerHeartbeat, &request, &reply); err != nil {
+			fmt.Printf("Could not send a heartbeat, will try again: %v\n", err)
+			continue
+		}
+		if reply.Accepted == false {
+			fmt.Printf("Server did not accept the heartbeat of Peer %v, reconnecting\n", request.PeerID)
+			p.ConnectServer()
+			continue
+		}
+		p.mu.Lock()
+		p.lease = reply.Lease
+		p.mu.Unlock()
+	}
+}
@@ -0,0 +1,164 @@
+/*
+	This file contains what a Peer keeps in its repository so that
+	it is recognized across restarts:
+		.peer-id          - a random UUID identifying the Peer to the Server
+		.published.json   - the files the Peer has published
+	On reconnecting, the Server gives the Peer its old PeerID back
+	and restorePublished() publishes again every file still on disk.
+
+	Several processes may share a repository (a running "peer serve"
+	and one-shot commands such as "peer publish"), so the list is
+	merged with what is on disk whenever it is saved, and a serving
+	Peer adopts the entries other processes added (see watch.go).
+*/
+
+package main
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/junvalentine/FileSharing/protocol"
+)
+
+const identityFile = ".peer-id"
+const publishedFile = ".published.json"
+
+/*
+	A file published by the Peer, as stored in publishedFile.
+*/
+type publishedEntry struct {
+	Name        string
+	Location    string
+	Description string
+	Tags        []string
+	Access      []string `json:",omitempty"`
+}
+
+/*
+	Returns the Peer identity stored in the repository,
+	generating and saving a new one the first time.
+*/
+func loadIdentity(directory string) (string, error) {
+	path := directory + identityFile
+	data, err := os.ReadFile(path)
+	if err == nil && len(strings.TrimSpace(string(data))) > 0 {
+		return strings.TrimSpace(string(data)), nil
+	}
+	if err != nil && !os.IsNotExist(err) {
+		return "", fmt.Errorf("reading identity: %v", err)
+	}
+
+	identity, err := newUUID()
+	if err != nil {
+		return "", err
+	}
+	if err := os.WriteFile(path, []byte(identity+"\n"), 0600); err != nil {
+		return "", fmt.Errorf("saving identity: %v", err)
+	}
+	return identity, nil
+}
+
+/*
+	Returns a random (version 4) UUID.
+*/
+func newUUID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16]), nil
+}
+
+/*
+	Returns the files listed in the repository as published.
+*/
+func (p *Peer) readPublished() []publishedEntry {
+	entries := []publishedEntry{}
+	data, err := os.ReadFile(p.directory + publishedFile)
+	if err == nil {
+		if err := json.Unmarshal(data, &entries); err != nil {
+			fmt.Printf("Error reading published files: %v\n", err)
+		}
+	}
+	return entries
+}
+
+/*
+	Writes the list of published files to the repository, keeping
+	the entries another process added since it was last read.
+	The caller must hold p.mu.
+*/
+func (p *Peer) savePublished() {
+	entries := make([]publishedEntry, 0, len(p.files))
+	for _, name := range p.fileNames() {
+		f := p.files[name]
+		entries = append(entries, publishedEntry{name, f.Location, f.Info.Description, f.Info.Tags, f.Info.Access})
+	}
+	for _, e := range p.readPublished() {
+		if _, ok := p.files[e.Name]; !ok && !p.unpublished[e.Name] {
+			entries = append(entries, e)
+		}
+	}
+	sort.Slice(entries, func(a, b int) bool {
+		return entries[a].Name < entries[b].Name
+	})
+	data, err := json.MarshalIndent(entries, "", "  ")
+	if err != nil {
+		return
+	}
+	path := p.directory + publishedFile
+	if err := os.WriteFile(path+".tmp", data, 0644); err != nil {
+		fmt.Printf("Error saving published files: %v\n", err)
+		return
+	}
+	os.Rename(path+".tmp", path)
+}
+
+/*
+	Publishes again the files listed in the repository that are
+	still on disk, then unregisters the files the Server still
+	lists for this Peer (serverFiles) but that are gone.
+*/
+func (p *Peer) restorePublished(serverFiles []string) {
+	restored := map[string]bool{}
+	for _, e := range p.readPublished() {
+		if _, err := os.Stat(e.Location + e.Name); err != nil {
+			fmt.Printf("%v is no longer on disk, not publishing it again\n", e.Name)
+			p.mu.Lock()
+			p.unpublished[e.Name] = true
+			p.mu.Unlock()
+			continue
+		}
+		if err := p.RegisterFile(e.Name, e.Location, e.Description, e.Tags, e.Access); err != nil {
+			fmt.Printf("Error publishing %v: %v\n", e.Name, err)
+			continue
+		}
+		restored[e.Name] = true
+	}
+
+	for _, name := range serverFiles {
+		if restored[name] {
+			continue
+		}
+		request := protocol.PeerSendFile{}
+		reply := protocol.ServerReceiveFile{}
+		request.FileName = name
+		request.PeerID = p.peerID()
+		if err := p.serverCall(protocol.ServerUnregister, &request, &reply); err != nil {
+			fmt.Printf("Error unregistering %v: %v\n", name, err)
+			continue
+		}
+		fmt.Printf("Unregistered file %v\n", name)
+	}
+
+	p.mu.Lock()
+	p.savePublished()
+	p.mu.Unlock()
+}
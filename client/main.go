@@ -1,24 +1,45 @@
 package main
 
 import (
+	"flag"
 	"fmt"
 	"time"
 	"bufio"
+	"io"
 	"os"
+	"os/signal"
 	"strings"
+	"syscall"
 )
 
-func main() {
-	var port string
-	fmt.Printf("Please enter a port number: ")
-	fmt.Scanf("%s", &port)
+/*
+	Standard input, shared by the prompt and the questions
+	commands ask, so no input is lost between them.
+*/
+var stdin = bufio.NewReader(os.Stdin)
 
-	var loc string
-	fmt.Printf("Please enter your local repository location: ")
-	fmt.Scanf("%s", &loc)
+func main() {
+	conf, args, err := LoadConfig(os.Args[1:])
+	if err == flag.ErrHelp {
+		os.Exit(0)
+	} else if err != nil {
+		fmt.Printf("Error loading configuration: %v\n", err)
+		os.Exit(2)
+	}
+	if len(args) > 0 {
+		os.Exit(runCommand(conf, args))
+	}
 
 	start := time.Now()
-	p := MakePeer(loc, ":"+ port)
+	p, err := MakePeer(conf.Repo, conf.Listen, conf.Tracker, conf.Advertise, conf.Token)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(exitCode(err))
+	}
+	if err := p.peerServer(conf.Listen); err != nil {
+		fmt.Printf("Error listening on %v: %v\n", conf.Listen, err)
+		os.Exit(1)
+	}
 	t1 := time.Now()
 	elapsed := t1.Sub(start)
 
@@ -26,7 +47,19 @@ func main() {
 	fmt.Printf("Total start time: %v\n", elapsed)
 	
 	t2 := time.Now()
-	p.ConnectServer()
+	if !p.ConnectServer() {
+		os.Exit(1)
+	}
+	go p.sendHeartbeats()
+	go p.watchFiles(watchInterval)
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-sig
+		fmt.Printf("Server shutting down\n")
+		p.Shutdown()
+		os.Exit(0)
+	}()
 	t3 := time.Now()
 	peerConnectServerTime := t3.Sub(t2)
 	fmt.Printf("Peer connect to server time : %v\n", peerConnectServerTime)
@@ -34,14 +67,18 @@ func main() {
 	for true {
 
 		fmt.Printf("\nPlease enter a command: \n")
-		fmt.Printf("1. publish [lname] [fname]\n")
+		fmt.Printf("1. publish [-to a.crt,...] [lname] [fname] [#tag ...] [+name|+@group ...] [description]\n")
 		fmt.Printf("2. fetch [fname]\n")
-		fmt.Printf("3. exit\n")
+		fmt.Printf("3. search [-regex|-glob] [-min N] [-max N] [-type T] [-tag T] [-page N] [query]\n")
+		fmt.Printf("4. unpublish [fname]\n")
+		fmt.Printf("5. exit\n")
 
-		var input string
-		reader := bufio.NewReader(os.Stdin)
-		input, _ = reader.ReadString('\n')
+		input, err := stdin.ReadString('\n')
 		// fmt.Printf("You entered: %s", input)
+		if err == io.EOF && input == "" {
+			fmt.Printf("Server shutting down\n")
+			break
+		}
 
 		if len(input) < 4 {
 			fmt.Printf("Incorrect command\n")
@@ -53,22 +90,68 @@ func main() {
 			if len(words) != 2 {
 				fmt.Printf("Incorrect command\n")
 			} else {
-				p.SearchForFile(strings.TrimSpace(words[1]))
+				if err := p.SearchForFile(strings.TrimSpace(words[1])); err != nil {
+					fmt.Printf("Error fetching file: %v\n", err)
+				}
 			}
 			//To do
+		} else if len(input) >= 9 && input[:9] == "unpublish" {
+			words := strings.Split(input, " ")
+			if len(words) != 2 {
+				fmt.Printf("Incorrect command\n")
+			} else if err := p.UnregisterFile(strings.TrimSpace(words[1])); err != nil {
+				fmt.Printf("Error unpublishing file: %v\n", err)
+			}
+		} else if len(input) >= 6 && input[:6] == "search" {
+			request, err := parseSearchArgs(strings.Fields(input)[1:])
+			if err != nil {
+				fmt.Printf("Incorrect command\n")
+				continue
+			}
+			if err := p.Search(request); err != nil {
+				fmt.Printf("Error searching: %v\n", err)
+			}
 		} else if len(input) >= 7 && input[:7] == "publish" {
 			words := strings.Split(input, " ")
-			if len(words) != 3 {
+			// With -to the file is encrypted for those certificates, see crypt.go.
+			var to []string
+			if len(words) >= 3 && words[1] == "-to" {
+				to = strings.Split(strings.TrimSpace(words[2]), ",")
+				words = append(words[:1], words[3:]...)
+			}
+			if len(words) < 3 {
 				fmt.Printf("Incorrect command\n")
 			} else {
 				filePath:=strings.TrimSpace(words[1])+strings.TrimSpace(words[2])
-				_, err := os.Stat(filePath)
+				stat, err := os.Stat(filePath)
 				if os.IsNotExist(err) {
 					fmt.Printf("File not exist in your local file system")
 					continue
 				}
-				p.RegisterFile(strings.TrimSpace(words[2]),strings.TrimSpace(words[1]))
-				fmt.Printf("Register file %s%s\n", strings.TrimSpace(words[1]), strings.TrimSpace(words[2]))
+				description, tags, access := parseDescription(words[3:])
+				if err == nil && stat.IsDir() && len(to) > 0 {
+					fmt.Printf("Encrypt the files of %v one at a time\n", filePath)
+					continue
+				}
+				if err == nil && stat.IsDir() {
+					if _, err := p.PublishDir(strings.TrimSpace(words[2]), strings.TrimSpace(words[1]), description, tags, access); err != nil {
+						fmt.Printf("Error registering directory: %v\n", err)
+					}
+					continue
+				}
+				location, name := strings.TrimSpace(words[1]), strings.TrimSpace(words[2])
+				if len(to) > 0 {
+					if name, err = p.encryptShare(filePath, to); err != nil {
+						fmt.Printf("Error encrypting file: %v\n", err)
+						continue
+					}
+					location = p.directory
+				}
+				if err := p.RegisterFile(name, location, description, tags, access); err != nil {
+					fmt.Printf("Error registering file: %v\n", err)
+					continue
+				}
+				fmt.Printf("Register file %s%s\n", location, name)
 			}
 			//To do
 		} else{
@@ -76,4 +159,5 @@ func main() {
 		}
 	}
 
+	p.Shutdown()
 }
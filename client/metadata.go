@@ -0,0 +1,92 @@
+/*
+	This file contains the functions that build the metadata
+	(protocol.FileInfo) sent to the Server when a file is registered.
+*/
+
+package main
+
+import (
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/junvalentine/FileSharing/protocol"
+)
+
+/*
+	Describes a file on disk: size, modification time, content
+	hashes and MIME type, plus the optional description, tags and
+	access list given by the publisher. Encrypted shares are
+	recognized by their header (see crypt.go).
+*/
+func describeFile(filePath string, fileName string, description string, tags []string, access []string) (protocol.FileInfo, error) {
+	info := protocol.FileInfo{}
+
+	stat, err := os.Stat(filePath)
+	if err != nil {
+		return info, err
+	}
+	hash, chunkHashes, err := hashFile(filePath)
+	if err != nil {
+		return info, err
+	}
+
+	info.Name = fileName
+	info.Size = stat.Size()
+	info.ModTime = stat.ModTime()
+	info.Hash = hash
+	info.ChunkHashes = chunkHashes
+	info.MimeType = detectMimeType(filePath)
+	info.Description = description
+	info.Tags = tags
+	info.Access = access
+	info.Encrypted = isEncrypted(filePath)
+	return info, nil
+}
+
+/*
+	Guesses the MIME type of a file from its extension, falling
+	back to sniffing its first bytes.
+*/
+func detectMimeType(filePath string) string {
+	if t := mime.TypeByExtension(filepath.Ext(filePath)); t != "" {
+		return strings.SplitN(t, ";", 2)[0]
+	}
+
+	f, err := os.Open(filePath)
+	if err != nil {
+		return "application/octet-stream"
+	}
+	defer f.Close()
+	buf := make([]byte, 512)
+	n, _ := f.Read(buf)
+	return strings.SplitN(http.DetectContentType(buf[:n]), ";", 2)[0]
+}
+
+/*
+	Splits the words following "publish [lname] [fname]" into tags
+	(words starting with '#'), the access list (words starting with
+	'+': "+alice" allows the Peer whose certificate is named alice,
+	"+@team" every Peer in group team) and a free-text description.
+*/
+func parseDescription(words []string) (string, []string, []string) {
+	description := []string{}
+	tags := []string{}
+	access := []string{}
+	for _, w := range words {
+		w = strings.TrimSpace(w)
+		if w == "" {
+			continue
+		}
+		if strings.HasPrefix(w, "#") && len(w) > 1 {
+			tags = append(tags, w[1:])
+		} else if strings.HasPrefix(w, "+") && len(w) > 1 {
+			access = append(access, w[1:])
+		} else {
+			description = append(description, w)
+		}
+	}
+	return strings.Join(description, " "), tags, access
+}
@@ -0,0 +1,118 @@
+/*
+	This file contains how a Peer ranks the holders of a file before
+	downloading it. Every holder is measured when it is contacted: how
+	long it took to answer (latency) and how many Peers it is already
+	sending chunks to (load). The Peer also remembers how downloads
+	from each holder went recently. Holders that answer fast, are idle
+	and served well before are used first; the others are kept as
+	standby in case a source fails.
+*/
+
+package main
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+/*
+	A Peer counts towards the load of a holder as long as it
+	fetched a chunk from it in the last uploadWindow.
+*/
+const uploadWindow = 10 * time.Second
+
+/*
+	Weight of the latest outcome in a holder's recent success
+	rate, and the rate assumed for holders never used before.
+*/
+const successWeight = 0.3
+const defaultSuccess = 0.5
+
+/*
+	Records that a chunk was just sent to a Peer.
+*/
+func (p *Peer) recordUpload(peerID int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.uploads[peerID] = time.Now()
+}
+
+/*
+	Returns how many Peers other than peerID this Peer
+	is currently sending chunks to.
+*/
+func (p *Peer) load(peerID int) int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	n := 0
+	for id, last := range p.uploads {
+		if time.Since(last) > uploadWindow {
+			delete(p.uploads, id)
+			continue
+		}
+		if id != peerID {
+			n++
+		}
+	}
+	return n
+}
+
+/*
+	Updates the recent success rate of a holder after
+	downloading from it (or failing to).
+*/
+func (p *Peer) recordOutcome(peerID int, ok bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	rate, known := p.history[peerID]
+	if !known {
+		rate = defaultSuccess
+	}
+	outcome := 0.0
+	if ok {
+		outcome = 1
+	}
+	p.history[peerID] = (1-successWeight)*rate + successWeight*outcome
+}
+
+func (p *Peer) successRate(peerID int) float64 {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if rate, ok := p.history[peerID]; ok {
+		return rate
+	}
+	return defaultSuccess
+}
+
+/*
+	Sorts sources best first: the lowest latency, weighted by
+	the load of the source and its recent success rate.
+*/
+func (p *Peer) rankSources(sources []*swarmSource) {
+	cost := map[*swarmSource]float64{}
+	for _, s := range sources {
+		s.success = p.successRate(s.PeerID)
+		cost[s] = float64(s.latency) * float64(1+s.load) / (0.1 + s.success)
+	}
+	sort.SliceStable(sources, func(a, b int) bool {
+		return cost[sources[a]] < cost[sources[b]]
+	})
+}
+
+/*
+	Prints the ranked sources, marking the ones on standby.
+*/
+func printSources(sources []*swarmSource, active int) {
+	fmt.Printf("Rank         PeerID      Address                  Latency      Load     Success\n")
+	for i, s := range sources {
+		rank := fmt.Sprintf("%v", i+1)
+		if i >= active {
+			rank += " (standby)"
+		}
+		fmt.Printf("%-12v %-11v %-24v %-12v %-8v %.0f%%\n", rank, s.PeerID, s.Addr, s.latency.Round(time.Microsecond), s.load, s.success*100)
+	}
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestRankSources(t *testing.T) {
+	p := downloadPeer()
+	p.history[3] = 0.9
+	p.history[4] = 0.1
+	sources := []*swarmSource{
+		{PeerID: 1, latency: time.Millisecond},
+		{PeerID: 2, latency: time.Millisecond, load: 1},
+		{PeerID: 3, latency: time.Millisecond},
+		{PeerID: 4, latency: time.Millisecond},
+		{PeerID: 5, latency: 4 * time.Millisecond},
+		{PeerID: 6, latency: time.Millisecond / 2},
+	}
+	order := func() []int {
+		p.rankSources(sources)
+		ids := []int{}
+		for _, s := range sources {
+			ids = append(ids, s.PeerID)
+		}
+		return ids
+	}
+
+	// The fastest first, then the ones that served well before, the
+	// idle ones before the busy ones, and the ones that failed before.
+	if got, want := order(), []int{6, 3, 1, 2, 4, 5}; !reflect.DeepEqual(got, want) {
+		t.Errorf("ranked %v, want %v", got, want)
+	}
+	if sources[1].success != 0.9 {
+		t.Errorf("success rate of Peer 3 is %v, want 0.9", sources[1].success)
+	}
+
+	// Failing a few downloads outweighs being fast.
+	for i := 0; i < 3; i++ {
+		p.recordOutcome(6, false)
+	}
+	if got, want := order(), []int{3, 1, 6, 2, 4, 5}; !reflect.DeepEqual(got, want) {
+		t.Errorf("after Peer 6 failed, ranked %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,148 @@
+/*
+	This file contains the sandbox every file a Peer serves or saves
+	goes through. File names come from other Peers and from the
+	Server, so they are never trusted: a name is resolved strictly
+	inside a root directory (the directory a file was published from,
+	or the one a download is saved to), and absolute names, ".."
+	segments and symlinks leading out of the root are rejected. The
+	repository's own files (.peer-id, .published.json) can be neither
+	served nor overwritten.
+*/
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/junvalentine/FileSharing/protocol"
+)
+
+/*
+	A directory names are resolved in. root is absolute
+	and has its symlinks resolved.
+*/
+type sandbox struct {
+	root string
+}
+
+/*
+	Returns the sandbox rooted at dir, which must exist.
+*/
+func newSandbox(dir string) (*sandbox, error) {
+	root, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+	root, err = filepath.EvalSymlinks(root)
+	if err != nil {
+		return nil, err
+	}
+	return &sandbox{root}, nil
+}
+
+/*
+	Returns true if path is the root or under it.
+*/
+func (s *sandbox) inside(path string) bool {
+	return path == s.root || strings.HasPrefix(path, s.root+string(filepath.Separator))
+}
+
+/*
+	Returns an error if name cannot be used in the sandbox.
+*/
+func (s *sandbox) check(name string) error {
+	if !protocol.ValidName(name) {
+		return fmt.Errorf("invalid file name %q", name)
+	}
+	if name == identityFile || name == publishedFile {
+		return fmt.Errorf("%v is reserved", name)
+	}
+	return nil
+}
+
+/*
+	Returns the path of the existing regular file name, with its
+	symlinks resolved, for reading it.
+*/
+func (s *sandbox) openPath(name string) (string, error) {
+	if err := s.check(name); err != nil {
+		return "", err
+	}
+	path, err := filepath.EvalSymlinks(filepath.Join(s.root, filepath.FromSlash(name)))
+	if err != nil {
+		return "", err
+	}
+	if !s.inside(path) {
+		return "", fmt.Errorf("%v leads out of %v", name, s.root)
+	}
+	stat, err := os.Stat(path)
+	if err != nil {
+		return "", err
+	}
+	if !stat.Mode().IsRegular() {
+		return "", fmt.Errorf("%v is not a regular file", name)
+	}
+	return path, nil
+}
+
+/*
+	Returns the path to save name to, creating the directories
+	leading to it. Directories that are symlinks must stay inside
+	the sandbox, and neither the file nor the partial download
+	files next to it may be symlinks, so writing to the path
+	cannot touch anything outside the sandbox.
+*/
+func (s *sandbox) savePath(name string) (string, error) {
+	if err := s.check(name); err != nil {
+		return "", err
+	}
+
+	dir := s.root
+	parts := strings.Split(name, "/")
+	for _, part := range parts[:len(parts)-1] {
+		next := filepath.Join(dir, part)
+		if _, err := os.Lstat(next); os.IsNotExist(err) {
+			if err := os.Mkdir(next, 0755); err != nil {
+				return "", err
+			}
+		}
+		next, err := filepath.EvalSymlinks(next)
+		if err != nil {
+			return "", err
+		}
+		if !s.inside(next) {
+			return "", fmt.Errorf("%v leads out of %v", name, s.root)
+		}
+		if stat, err := os.Stat(next); err != nil {
+			return "", err
+		} else if !stat.IsDir() {
+			return "", fmt.Errorf("%v is not a directory", part)
+		}
+		dir = next
+	}
+
+	path := filepath.Join(dir, parts[len(parts)-1])
+	for _, p := range []string{path, partPath(path), statePath(path)} {
+		if stat, err := os.Lstat(p); err == nil && stat.Mode()&os.ModeSymlink != 0 {
+			return "", fmt.Errorf("%v is a symlink", p)
+		}
+	}
+	return path, nil
+}
+
+/*
+	Returns the path to save name to inside dir, creating dir if needed.
+*/
+func savePath(dir string, name string) (string, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+	s, err := newSandbox(dir)
+	if err != nil {
+		return "", err
+	}
+	return s.savePath(name)
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/junvalentine/FileSharing/protocol"
+)
+
+/*
+	Creates a repository with a shared file, a secret file outside
+	it and symlinks leading out of it:
+		outside/secret
+		repo/notes.txt
+		repo/docs/a.txt
+		repo/link-file -> outside/secret
+		repo/link-dir  -> outside
+		repo/inner     -> docs
+*/
+func makeRepo(t *testing.T) (repo string, outside string) {
+	t.Helper()
+	base := t.TempDir()
+	repo = filepath.Join(base, "repo")
+	outside = filepath.Join(base, "outside")
+	for _, dir := range []string{filepath.Join(repo, "docs"), outside} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	files := map[string]string{
+		filepath.Join(outside, "secret"):     "secret",
+		filepath.Join(repo, "notes.txt"):     "notes",
+		filepath.Join(repo, "docs", "a.txt"): "a",
+		filepath.Join(repo, identityFile):    "id",
+		filepath.Join(repo, publishedFile):   "[]",
+	}
+	for path, data := range files {
+		if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	links := map[string]string{
+		filepath.Join(repo, "link-file"): filepath.Join(outside, "secret"),
+		filepath.Join(repo, "link-dir"):  outside,
+		filepath.Join(repo, "inner"):     "docs",
+	}
+	for link, target := range links {
+		if err := os.Symlink(target, link); err != nil {
+			t.Skipf("symlinks not supported: %v", err)
+		}
+	}
+	return repo, outside
+}
+
+func TestOpenPath(t *testing.T) {
+	repo, _ := makeRepo(t)
+	s, err := newSandbox(repo)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	allowed := []string{"notes.txt", "docs/a.txt", "inner/a.txt"}
+	for _, name := range allowed {
+		path, err := s.openPath(name)
+		if err != nil {
+			t.Errorf("openPath(%q): %v", name, err)
+		} else if !s.inside(path) {
+			t.Errorf("openPath(%q) = %v, outside the sandbox", name, path)
+		}
+	}
+
+	rejected := []string{
+		"",
+		"/etc/passwd",
+		"../outside/secret",
+		"docs/../../outside/secret",
+		"docs/../notes.txt",
+		"./notes.txt",
+		"docs/",
+		"..\\outside\\secret",
+		"link-file",
+		"link-dir/secret",
+		"docs",
+		"missing.txt",
+		identityFile,
+		publishedFile,
+	}
+	for _, name := range rejected {
+		if path, err := s.openPath(name); err == nil {
+			t.Errorf("openPath(%q) = %v, want an error", name, path)
+		}
+	}
+}
+
+func TestSavePath(t *testing.T) {
+	repo, outside := makeRepo(t)
+	s, err := newSandbox(repo)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path, err := s.savePath("new/deep/file.bin")
+	if err != nil {
+		t.Fatalf("savePath: %v", err)
+	}
+	if want := filepath.Join(s.root, "new", "deep", "file.bin"); path != want {
+		t.Errorf("savePath = %v, want %v", path, want)
+	}
+	if stat, err := os.Stat(filepath.Dir(path)); err != nil || !stat.IsDir() {
+		t.Errorf("savePath did not create %v", filepath.Dir(path))
+	}
+	if _, err := s.savePath("inner/b.txt"); err != nil {
+		t.Errorf("savePath through a symlink inside the sandbox: %v", err)
+	}
+
+	if err := os.Symlink(filepath.Join(outside, "secret"), filepath.Join(repo, "docs", "b.txt.part")); err != nil {
+		t.Fatal(err)
+	}
+	rejected := []string{
+		"/tmp/evil",
+		"../evil",
+		"docs/../../evil",
+		"link-dir/evil",
+		"link-dir/sub/evil",
+		"link-file",
+		"notes.txt/evil",
+		"docs/b.txt",
+		identityFile,
+		publishedFile,
+	}
+	for _, name := range rejected {
+		if path, err := s.savePath(name); err == nil {
+			t.Errorf("savePath(%q) = %v, want an error", name, path)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(outside, "sub")); err == nil {
+		t.Errorf("savePath created a directory outside the sandbox")
+	}
+}
+
+func TestServeOutsideRepository(t *testing.T) {
+	repo, outside := makeRepo(t)
+	p := &Peer{directory: repo + "/", files: map[string]*sharedFile{}}
+	p.files["notes.txt"] = &sharedFile{Location: repo + "/"}
+	p.files["../outside/secret"] = &sharedFile{Location: repo + "/"}
+	p.files["link-file"] = &sharedFile{Location: repo + "/"}
+	p.files[identityFile] = &sharedFile{Location: repo + "/"}
+	p.uploads = map[int]time.Time{}
+
+	names := []string{"../outside/secret", "link-file", identityFile, filepath.Join(outside, "secret"), "../../etc/passwd"}
+	for _, name := range names {
+		request := protocol.RequestChunkArgs{File: name}
+		reply := protocol.RequestChunkReply{}
+		if err := p.ServeChunk(&request, &reply); err != nil {
+			t.Fatal(err)
+		}
+		if reply.FileExists || strings.Contains(string(reply.Data), "secret") {
+			t.Errorf("ServeChunk(%q) served %q", name, reply.Data)
+		}
+	}
+
+	request := protocol.RequestChunkArgs{File: "notes.txt"}
+	reply := protocol.RequestChunkReply{}
+	if err := p.ServeChunk(&request, &reply); err != nil || string(reply.Data) != "notes" {
+		t.Errorf("ServeChunk(notes.txt) = %q, %v", reply.Data, err)
+	}
+}
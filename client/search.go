@@ -0,0 +1,92 @@
+/*
+	This file contains the Peer side of the search command. The
+	query is sent to Server.Search() and the matching files are
+	printed one page at a time, one line per distinct content.
+*/
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"strings"
+
+	"github.com/junvalentine/FileSharing/protocol"
+)
+
+/*
+	Parses the arguments of the search command:
+		search [-regex|-glob] [-min N] [-max N] [-type T] [-tag T] [-page N] [-n N] [query]
+	Without -regex or -glob, a query containing '*', '?' or '['
+	is matched as a glob and any other query as a substring.
+*/
+func parseSearchArgs(words []string) (protocol.SearchArgs, error) {
+	request := protocol.SearchArgs{}
+
+	fs := flag.NewFlagSet("search", flag.ContinueOnError)
+	regex := fs.Bool("regex", false, "match the query as a regular expression")
+	glob := fs.Bool("glob", false, "match the query as a glob pattern")
+	fs.Int64Var(&request.MinSize, "min", 0, "minimum file size in bytes")
+	fs.Int64Var(&request.MaxSize, "max", 0, "maximum file size in bytes")
+	fs.StringVar(&request.MimeType, "type", "", "MIME type or prefix, e.g. image/")
+	fs.StringVar(&request.Tag, "tag", "", "tag the file must carry")
+	fs.IntVar(&request.Page, "page", 1, "page of results to show")
+	fs.IntVar(&request.PageSize, "n", 20, "number of results per page")
+	query, err := parseArgs(fs, words)
+	if err != nil {
+		return request, err
+	}
+	request.Query = strings.Join(query, " ")
+
+	switch {
+	case *regex:
+		request.Mode = protocol.MatchRegex
+	case *glob || strings.ContainsAny(request.Query, "*?["):
+		request.Mode = protocol.MatchGlob
+	default:
+		request.Mode = protocol.MatchSubstring
+	}
+	return request, nil
+}
+
+/*
+	Searches the files registered on the Server and prints
+	one page of results.
+*/
+func (p *Peer) Search(request protocol.SearchArgs) error {
+	reply, err := p.searchFiles(request)
+	if err != nil {
+		return err
+	}
+	printSearchReply(&request, &reply)
+	return nil
+}
+
+/*
+	Returns one page of the files registered on the Server
+	matching the request.
+*/
+func (p *Peer) searchFiles(request protocol.SearchArgs) (protocol.SearchReply, error) {
+	reply := protocol.SearchReply{}
+	request.PeerID = p.peerID()
+	err := p.serverCall(protocol.ServerSearch, &request, &reply)
+	return reply, err
+}
+
+func printSearchReply(request *protocol.SearchArgs, reply *protocol.SearchReply) {
+	if reply.Total == 0 {
+		fmt.Printf("No file matches %q\n", request.Query)
+		return
+	}
+
+	fmt.Printf("Num      Size         Type                     Peers    Hash           Files\n")
+	for i, result := range reply.Results {
+		info := result.Info
+		num := (reply.Page-1)*reply.PageSize + i + 1
+		fmt.Printf("%-8v %-12v %-24v %-8v %-14.12v %v\n", num, info.Size, info.MimeType, result.Holders, info.Hash, strings.Join(result.Names, ", "))
+		if info.Description != "" || len(info.Tags) > 0 || len(info.Access) > 0 || info.Encrypted {
+			fmt.Printf("         %v %v %v\n", info.Description, info.FormatTags(), info.FormatAccess())
+		}
+	}
+	fmt.Printf("Page %v/%v (%v files)\n", reply.Page, reply.NumPages, reply.Total)
+}
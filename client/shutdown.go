@@ -0,0 +1,129 @@
+/*
+	This file contains how a Peer shuts down. It first tells the
+	Server it is leaving, so searches stop returning it, then stops
+	accepting connections and refuses new downloads. Peers already
+	downloading from it keep getting chunks until they have been
+	quiet for drainIdle, or until drainTimeout; a download cut off
+	after that fails over to another holder (see swarm.go).
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/junvalentine/FileSharing/protocol"
+)
+
+/*
+	How long a shutting down Peer waits for the downloads
+	it serves to finish, at most.
+*/
+const drainTimeout = 30 * time.Second
+
+/*
+	A download is considered finished once no chunk of it
+	was requested for drainIdle.
+*/
+const drainIdle = 2 * time.Second
+
+/*
+	How long the Server is given to acknowledge the Peer leaving.
+*/
+const disconnectTimeout = 5 * time.Second
+
+/*
+	Shuts the Peer down. Calling it again while it
+	runs returns immediately.
+*/
+func (p *Peer) Shutdown() {
+	p.mu.Lock()
+	if p.closing {
+		p.mu.Unlock()
+		return
+	}
+	p.closing = true
+	p.mu.Unlock()
+
+	p.disconnect()
+	if p.listener != nil {
+		p.listener.Close()
+	}
+	p.drain()
+	fmt.Printf("Peer shut down\n")
+}
+
+/*
+	Returns true once the Peer started shutting down.
+*/
+func (p *Peer) isClosing() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.closing
+}
+
+/*
+	Tells the Server the Peer is leaving.
+*/
+func (p *Peer) disconnect() {
+	peerID := p.peerID()
+	if peerID < 0 {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), disconnectTimeout)
+	defer cancel()
+	ctx = p.trackerContext(ctx)
+
+	request := protocol.DisconnectArgs{PeerID: peerID}
+	reply := protocol.DisconnectReply{}
+	if err := protocol.Call(ctx, p.Tracker, protocol.ServerDisconnect, &request, &reply); err != nil {
+		fmt.Printf("Could not disconnect from the server: %v\n", err)
+		return
+	}
+	fmt.Printf("Disconnected from server\n")
+}
+
+/*
+	Waits until no chunk is being sent and none was requested
+	for drainIdle, or until drainTimeout.
+*/
+func (p *Peer) drain() {
+	deadline := time.Now().Add(drainTimeout)
+	for {
+		p.mu.Lock()
+		inflight := p.inflight
+		last := time.Time{}
+		for _, t := range p.uploads {
+			if t.After(last) {
+				last = t
+			}
+		}
+		p.mu.Unlock()
+
+		if inflight == 0 && time.Since(last) >= drainIdle {
+			return
+		}
+		if time.Now().After(deadline) {
+			fmt.Printf("Gave up waiting for %v downloads to finish\n", p.load(-1))
+			return
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+/*
+	Marks a chunk as being sent, so drain() waits for it.
+*/
+func (p *Peer) beginChunk() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.inflight++
+}
+
+func (p *Peer) endChunk() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.inflight--
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/junvalentine/FileSharing/protocol"
+)
+
+/*
+	Asks the source for the target file, as a new download would.
+*/
+func openDownload(s *swarmSource, target *protocol.FileInfo) (protocol.RequestFileReply, error) {
+	request := protocol.RequestFileArgs{PeerID: 100, File: target.Name}
+	reply := protocol.RequestFileReply{}
+	err := protocol.CallClient(context.Background(), s.client, s.Addr, protocol.PeerServeFile, &request, &reply)
+	return reply, err
+}
+
+func TestShutdownDrain(t *testing.T) {
+	repo, _ := makeRepo(t)
+	target := makeChunkedFile(t, repo, "big.bin", 4)
+	p := startSharing(t, 1, repo, target)
+	// Not connected to a Server, so there is nobody to tell.
+	p.PeerID = -1
+	addr := p.listener.Addr().String()
+
+	// One download started before the shutdown, another
+	// Peer is connected but did not ask for the file yet.
+	running := dialSource(t, 1, addr)
+	if reply, err := openDownload(running, &target); err != nil || !reply.FileExists {
+		t.Fatalf("opening the download: %+v, %v", reply, err)
+	}
+	idle := dialSource(t, 1, addr)
+
+	done := make(chan struct{})
+	go func() {
+		p.Shutdown()
+		close(done)
+	}()
+	for !p.isClosing() {
+		time.Sleep(time.Millisecond)
+	}
+
+	// New downloads are refused, on open connections or new ones.
+	if reply, err := openDownload(idle, &target); err != nil || reply.FileExists {
+		t.Errorf("a new download was accepted during shutdown: %+v, %v", reply, err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if c, err := protocol.Dial(ctx, addr); err == nil {
+		c.Close()
+		t.Errorf("a new connection was accepted during shutdown")
+	}
+
+	// The running download still gets every chunk.
+	filePath := filepath.Join(t.TempDir(), target.Name)
+	if !saveFile([]*swarmSource{running}, nil, &target, 100, filePath) {
+		t.Fatal("the running download failed")
+	}
+	select {
+	case <-done:
+		t.Errorf("Shutdown returned before the running download finished")
+	default:
+	}
+	select {
+	case <-done:
+	case <-time.After(drainIdle + 5*time.Second):
+		t.Errorf("Shutdown did not return once the download finished")
+	}
+	hash, _, err := hashFile(filePath)
+	if err != nil || hash != target.Hash {
+		t.Errorf("saved file hashes to %v (%v), want %v", hash, err, target.Hash)
+	}
+}
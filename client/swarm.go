@@ -0,0 +1,284 @@
+/*
+	This file contains the swarm downloader. A file is split into
+	ChunkSize pieces that are pulled concurrently from every Peer
+	holding it. Each source has a worker taking chunk indices from a
+	shared queue, so fast sources naturally serve more chunks; a chunk
+	that fails, times out or does not match its SHA-256 goes back on
+	the queue for another source, and a source that keeps failing is
+	dropped from the swarm.
+
+	At most maxSources holders are used at once, the best ranked ones
+	(see ranking.go). The others are kept on standby and take over, in
+	order, from the sources that get dropped.
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/rpc"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/junvalentine/FileSharing/protocol"
+)
+
+/*
+	How long a source gets to serve one chunk before the chunk
+	is handed to another source.
+*/
+const chunkTimeout = 30 * time.Second
+
+/*
+	Number of consecutive failed chunks after which a source
+	is dropped from the swarm.
+*/
+const maxSourceFailures = 3
+
+/*
+	Number of holders downloaded from at once.
+*/
+const maxSources = 4
+
+/*
+	A Peer that files are being downloaded from.
+*/
+type swarmSource struct {
+	PeerID   int
+	Addr     string
+	client   *rpc.Client
+	latency  time.Duration
+	load     int
+	success  float64
+	failures int
+	served   int
+	retired  bool
+}
+
+/*
+	Outcome of one chunk fetched by a source worker.
+*/
+type chunkResult struct {
+	index  int
+	source *swarmSource
+	err    error
+	retire bool
+}
+
+/*
+	Connects to a Peer holding the target file and asks it for the
+	file's size, which must agree with the published metadata.
+	The time this takes is the latency of the source. With TLS the
+	Peer must hold the certificate it registered with, named name.
+	The returned source must be closed by the caller.
+*/
+func (p *Peer) openSource(id int, addr string, name string, target *protocol.FileInfo) (*swarmSource, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), protocol.CallTimeout)
+	defer cancel()
+	ctx = protocol.ExpectName(ctx, name)
+	start := time.Now()
+
+	c, err := protocol.Dial(ctx, addr)
+	if err != nil {
+		return nil, err
+	}
+	s := &swarmSource{PeerID: id, Addr: addr, client: c}
+
+	if !p.ConnectPeer(ctx, s) {
+		c.Close()
+		return nil, fmt.Errorf("connection refused")
+	}
+
+	request := protocol.RequestFileArgs{}
+	reply := protocol.RequestFileReply{}
+	request.PeerID = p.peerID()
+	request.File = target.Name
+	if err := protocol.CallClient(ctx, c, addr, protocol.PeerServeFile, &request, &reply); err != nil {
+		c.Close()
+		return nil, err
+	}
+	if reply.FileExists == false {
+		c.Close()
+		return nil, fmt.Errorf("the file does not exist")
+	}
+	if reply.Size != target.Size || numChunks(reply.Size) != len(target.ChunkHashes) {
+		c.Close()
+		return nil, fmt.Errorf("its copy does not match the published metadata")
+	}
+	s.latency = time.Since(start)
+	s.load = reply.Load
+	return s, nil
+}
+
+/*
+	A Peer that served part of a download.
+*/
+type servedBy struct {
+	PeerID int    `json:"peerId"`
+	Addr   string `json:"addr"`
+	Chunks int    `json:"chunks"`
+}
+
+/*
+	Downloads the target copy of a file from the Peers listed in a
+	FindPeerReply as holding it, and saves it to filePath. Holders of
+	other contents under the same name are skipped. Every holder is
+	contacted and ranked, the best maxSources are downloaded from at
+	once and the rest take over when one of them fails. Returns the
+	Peers that served the file, and true once the whole file is
+	saved and verified.
+*/
+func (p *Peer) SwarmDownload(holders *protocol.FindPeerReply, target *protocol.FileInfo, filePath string) ([]servedBy, bool) {
+	sources := p.openSources(holders, target)
+	defer func() {
+		for _, s := range sources {
+			s.client.Close()
+		}
+	}()
+
+	if len(sources) == 0 {
+		fmt.Printf("Did not receive %v, no Peer could serve it\n", target.Name)
+		return nil, false
+	}
+
+	p.rankSources(sources)
+	active := len(sources)
+	if active > maxSources {
+		active = maxSources
+	}
+	printSources(sources, active)
+
+	fmt.Printf("Receiving %v (%v bytes) from %v Peer(s)\n", target.Name, target.Size, active)
+	save := saveFile(sources[:active:active], failover(sources[active:]), target, p.peerID(), filePath)
+	served := []servedBy{}
+	for _, s := range sources {
+		if s.served > 0 {
+			served = append(served, servedBy{s.PeerID, s.Addr, s.served})
+		}
+		if s.retired {
+			p.recordOutcome(s.PeerID, false)
+		} else if s.served > 0 {
+			p.recordOutcome(s.PeerID, true)
+		}
+	}
+	return served, save
+}
+
+/*
+	Returns a function handing out the standby sources in
+	order, then nil once they are used up.
+*/
+func failover(standby []*swarmSource) func() *swarmSource {
+	return func() *swarmSource {
+		if len(standby) == 0 {
+			return nil
+		}
+		s := standby[0]
+		standby = standby[1:]
+		fmt.Printf("Failing over to Peer %v (%v)\n", s.PeerID, s.Addr)
+		return s
+	}
+}
+
+/*
+	Contacts every holder of the target copy at once and returns
+	the ones that can serve it.
+*/
+func (p *Peer) openSources(holders *protocol.FindPeerReply, target *protocol.FileInfo) []*swarmSource {
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	sources := []*swarmSource{}
+	self := p.peerID()
+	for i := 0; i < len(holders.PeerID); i++ {
+		if holders.PeerID[i] == self || holders.Info[i].Hash != target.Hash {
+			continue
+		}
+		wg.Add(1)
+		go func(id int, addr string, name string) {
+			defer wg.Done()
+			s, err := p.openSource(id, addr, name, target)
+			if err != nil {
+				fmt.Printf("Skipping Peer %v: %v\n", id, err)
+				p.recordOutcome(id, false)
+				return
+			}
+			mu.Lock()
+			sources = append(sources, s)
+			mu.Unlock()
+		}(holders.PeerID[i], holders.Addr[i], holders.HolderName(i))
+	}
+	wg.Wait()
+	return sources
+}
+
+/*
+	Worker pulling chunk indices from pending and fetching them
+	from one source until the download stops or the source has
+	failed too many times in a row.
+*/
+func (s *swarmSource) work(f *os.File, target *protocol.FileInfo, id int, pending chan int, results chan chunkResult, stop chan struct{}) {
+	for {
+		var i int
+		select {
+		case i = <-pending:
+		case <-stop:
+			return
+		}
+
+		err := s.fetchChunk(f, target, id, i)
+		r := chunkResult{index: i, source: s, err: err}
+		if err != nil {
+			s.failures++
+			r.retire = s.failures >= maxSourceFailures
+		} else {
+			s.failures = 0
+		}
+
+		select {
+		case results <- r:
+		case <-stop:
+			return
+		}
+		if r.retire {
+			return
+		}
+	}
+}
+
+/*
+	Fetches chunk i from the source, checks it against its published
+	hash and writes it at its offset in f. Gives up after chunkTimeout.
+*/
+func (s *swarmSource) fetchChunk(f *os.File, target *protocol.FileInfo, id int, i int) error {
+	offset := int64(i) * protocol.ChunkSize
+	request := protocol.RequestChunkArgs{}
+	reply := protocol.RequestChunkReply{}
+	request.PeerID = id
+	request.File = target.Name
+	request.Offset = offset
+
+	ctx, cancel := context.WithTimeout(context.Background(), chunkTimeout)
+	defer cancel()
+	if err := protocol.CallClient(ctx, s.client, s.Addr, protocol.PeerServeChunk, &request, &reply); err != nil {
+		return err
+	}
+	if reply.FileExists == false {
+		return fmt.Errorf("%v", reply.ErrorMessage)
+	}
+
+	want := target.Size - offset
+	if want > protocol.ChunkSize {
+		want = protocol.ChunkSize
+	}
+	if int64(len(reply.Data)) != want {
+		return fmt.Errorf("got %v bytes, expected %v", len(reply.Data), want)
+	}
+	if hashChunk(reply.Data) != target.ChunkHashes[i] {
+		return fmt.Errorf("chunk failed verification")
+	}
+
+	_, err := f.WriteAt(reply.Data, offset)
+	return err
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/junvalentine/FileSharing/protocol"
+)
+
+/*
+	Returns a Peer that is only used to download.
+*/
+func downloadPeer() *Peer {
+	return &Peer{PeerID: 100, files: map[string]*sharedFile{}, peers: map[int]bool{}, uploads: map[int]time.Time{}, history: map[int]float64{}}
+}
+
+func TestSwarmDownload(t *testing.T) {
+	repo, _ := makeRepo(t)
+	target := makeChunkedFile(t, repo, "big.bin", 8)
+	holders := protocol.FindPeerReply{}
+	for id := 1; id <= 2; id++ {
+		holders.PeerID = append(holders.PeerID, id)
+		holders.Addr = append(holders.Addr, sharePeer(t, id, repo, target))
+		holders.Info = append(holders.Info, target)
+	}
+	// Holders of other contents under the same name are skipped.
+	other := target
+	other.Hash = "other"
+	holders.PeerID = append(holders.PeerID, 3)
+	holders.Addr = append(holders.Addr, "127.0.0.1:1")
+	holders.Info = append(holders.Info, other)
+
+	p := downloadPeer()
+	filePath := filepath.Join(t.TempDir(), target.Name)
+	served, ok := p.SwarmDownload(&holders, &target, filePath)
+	if !ok {
+		t.Fatal("SwarmDownload failed")
+	}
+	if len(served) != 2 || served[0].Chunks+served[1].Chunks != 8 {
+		t.Errorf("served by %+v, want both holders sharing 8 chunks", served)
+	}
+	hash, _, err := hashFile(filePath)
+	if err != nil || hash != target.Hash {
+		t.Errorf("saved file hashes to %v (%v), want %v", hash, err, target.Hash)
+	}
+	for _, id := range []int{1, 2} {
+		if rate := p.successRate(id); rate <= defaultSuccess {
+			t.Errorf("success rate of Peer %v is %v after serving the file", id, rate)
+		}
+	}
+}
+
+func dialSource(t *testing.T, peerID int, addr string) *swarmSource {
+	t.Helper()
+	c, err := protocol.Dial(context.Background(), addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return &swarmSource{PeerID: peerID, Addr: addr, client: c}
+}
+
+func TestFailover(t *testing.T) {
+	repo, _ := makeRepo(t)
+	target := makeChunkedFile(t, repo, "big.bin", 6)
+
+	// The active source's copy goes bad after its third chunk.
+	badRepo := t.TempDir()
+	makeChunkedFile(t, badRepo, "big.bin", 6)
+	badPath := filepath.Join(badRepo, "big.bin")
+	data, err := os.ReadFile(badPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 3; i < 6; i++ {
+		data[i*protocol.ChunkSize] ^= 0xff
+	}
+	if err := os.WriteFile(badPath, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	bad := dialSource(t, 1, sharePeer(t, 1, badRepo, target))
+	standby := dialSource(t, 2, sharePeer(t, 2, repo, target))
+	unused := dialSource(t, 3, sharePeer(t, 3, repo, target))
+	filePath := filepath.Join(t.TempDir(), target.Name)
+	if !saveFile([]*swarmSource{bad}, failover([]*swarmSource{standby, unused}), &target, 100, filePath) {
+		t.Fatal("saveFile failed")
+	}
+	if bad.served != 3 || !bad.retired {
+		t.Errorf("active source served %v chunks, retired %v, want 3 and dropped", bad.served, bad.retired)
+	}
+	if standby.served != 3 || unused.served != 0 {
+		t.Errorf("standby sources served %v and %v chunks, want 3 and 0", standby.served, unused.served)
+	}
+	hash, _, err := hashFile(filePath)
+	if err != nil || hash != target.Hash {
+		t.Errorf("saved file hashes to %v (%v), want %v", hash, err, target.Hash)
+	}
+}
@@ -0,0 +1,115 @@
+/*
+	This file contains the watcher that keeps the Server's registry
+	in line with the Peer's disk. Registered files are checked
+	periodically: a file that was deleted is unregistered, and a file
+	whose size or modification time changed is registered again so
+	the Server holds its new hashes. Files another process added to
+	the repository's published list (e.g. "peer publish") are
+	published too, and files the Server could not register are
+	registered again.
+*/
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"time"
+)
+
+/*
+	How often the registered files are checked.
+*/
+const watchInterval = 5 * time.Second
+
+/*
+	Checks the registered files every interval, until
+	the Peer shuts down.
+*/
+func (p *Peer) watchFiles(interval time.Duration) {
+	for {
+		time.Sleep(interval)
+		if p.isClosing() {
+			return
+		}
+		p.adoptPublished()
+		p.checkFiles()
+	}
+}
+
+/*
+	Publishes the files listed in the repository that this Peer
+	does not know about yet, or that the Server did not register.
+	A file that cannot be published (e.g. it is missing) is dropped
+	from the list; one the Server failed to register stays in it
+	and is tried again on the next pass.
+*/
+func (p *Peer) adoptPublished() {
+	for _, e := range p.readPublished() {
+		p.mu.Lock()
+		f, known := p.files[e.Name]
+		skip := (known && f.registered) || p.unpublished[e.Name]
+		p.mu.Unlock()
+		if skip {
+			continue
+		}
+
+		if known {
+			fmt.Printf("Registering %v with the server again\n", e.Name)
+		} else {
+			fmt.Printf("%v was published by another process, publishing it\n", e.Name)
+		}
+		if err := p.RegisterFile(e.Name, e.Location, e.Description, e.Tags, e.Access); err != nil {
+			fmt.Printf("Error publishing %v: %v\n", e.Name, err)
+			p.mu.Lock()
+			if _, shared := p.files[e.Name]; !shared {
+				p.unpublished[e.Name] = true
+			}
+			p.mu.Unlock()
+		}
+	}
+}
+
+/*
+	Compares every registered file with what is on disk and
+	unregisters or re-registers the ones that changed.
+*/
+func (p *Peer) checkFiles() {
+	type watched struct {
+		name     string
+		location string
+		size     int64
+		modTime  time.Time
+		desc     string
+		tags     []string
+		access   []string
+	}
+
+	p.mu.Lock()
+	files := make([]watched, 0, len(p.files))
+	for _, name := range p.fileNames() {
+		info := p.files[name].Info
+		files = append(files, watched{name, p.files[name].Location, info.Size, info.ModTime, info.Description, info.Tags, info.Access})
+	}
+	p.mu.Unlock()
+
+	for _, f := range files {
+		stat, err := os.Stat(f.location + f.name)
+		if os.IsNotExist(err) {
+			fmt.Printf("%v was deleted, unpublishing it\n", f.name)
+			if err := p.UnregisterFile(f.name); err != nil {
+				fmt.Printf("Error unpublishing %v: %v\n", f.name, err)
+			}
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if stat.Size() != f.size || !stat.ModTime().Equal(f.modTime) {
+			fmt.Printf("%v was modified, publishing the new version\n", f.name)
+			if err := p.RegisterFile(f.name, f.location, f.desc, f.tags, f.access); err != nil {
+				fmt.Printf("Error publishing %v: %v\n", f.name, err)
+			}
+		}
+	}
+}
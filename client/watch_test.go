@@ -0,0 +1,52 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestAdoptPublished(t *testing.T) {
+	repo, _ := makeRepo(t)
+	p := &Peer{directory: repo + "/", files: map[string]*sharedFile{}, unpublished: map[string]bool{}}
+	tracker := startTracker(t, p, false)
+
+	// Another process published a file, and one that is gone since.
+	entries := []publishedEntry{{Name: "gone.txt", Location: repo + "/"}, {Name: "notes.txt", Location: repo + "/"}}
+	data, err := json.Marshal(entries)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(repo+"/"+publishedFile, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	listed := func() []string {
+		names := []string{}
+		for _, e := range p.readPublished() {
+			names = append(names, e.Name)
+		}
+		return names
+	}
+
+	// The Server refuses: notes.txt is still shared and listed.
+	p.adoptPublished()
+	if f, ok := p.files["notes.txt"]; !ok || f.registered || p.unpublished["notes.txt"] {
+		t.Errorf("notes.txt after the Server refused it: %+v, unpublished %v", f, p.unpublished["notes.txt"])
+	}
+	if !p.unpublished["gone.txt"] {
+		t.Errorf("gone.txt was not dropped")
+	}
+	if got, want := listed(), []string{"notes.txt"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("listed %q, want %q", got, want)
+	}
+
+	// The next pass registers it, and the one after has nothing to do.
+	tracker.accept = true
+	p.adoptPublished()
+	p.adoptPublished()
+	if !p.files["notes.txt"].registered || !reflect.DeepEqual(tracker.registered, []string{"notes.txt"}) {
+		t.Errorf("registered %q, want notes.txt once", tracker.registered)
+	}
+}
@@ -0,0 +1,3 @@
+module github.com/junvalentine/FileSharing
+
+go 1.21.4
@@ -0,0 +1,174 @@
+/*
+	This file contains the RPCs of the Server's admin endpoint, which
+	the "tracker peers|files|ping|discover|evict" commands use to
+	inspect and manage a running Server, and the "tracker token"
+	commands to manage the tokens Peers join with. The endpoint
+	listens on its own address, separate from the one Peers connect to.
+*/
+
+package protocol
+
+import "time"
+
+/*
+	Names of the RPC methods served by the admin endpoint.
+*/
+const (
+	AdminPeers    = "Admin.Peers"
+	AdminFiles    = "Admin.Files"
+	AdminPing     = "Admin.Ping"
+	AdminDiscover = "Admin.Discover"
+	AdminEvict    = "Admin.Evict"
+	AdminTokens   = "Admin.Tokens"
+	AdminIssue    = "Admin.IssueToken"
+	AdminRevoke   = "Admin.RevokeToken"
+)
+
+/*
+	Status of a Peer as seen by the Server.
+*/
+const (
+	StatusOnline     = "online"
+	StatusOffline    = "offline"
+	StatusUnverified = "unverified"
+)
+
+/*
+	Start of the error the admin RPCs about one Peer
+	return when the Server has no Peer with that PeerID.
+*/
+const UnknownPeer = "no Peer with ID"
+
+/*
+	Start of the error Admin.RevokeToken returns when
+	the Server has no token with that ID.
+*/
+const UnknownToken = "no token with ID"
+
+/*
+	Arguments of the admin RPCs that take no arguments.
+*/
+type AdminArgs struct{}
+
+/*
+	Arguments of the admin RPCs about one Peer.
+*/
+type AdminPeerArgs struct {
+	PeerID int
+}
+
+/*
+	A Peer known to the Server.
+*/
+type PeerStatus struct {
+	PeerID   int       `json:"peerId"`
+	Identity string    `json:"identity"`
+	Addr     string    `json:"addr"`
+	CertName string    `json:"certName"`
+	User     string    `json:"user"`
+	Status   string    `json:"status"`
+	LastSeen time.Time `json:"lastSeen"`
+	NumFiles int       `json:"numFiles"`
+}
+
+/*
+	Reply to Admin.Peers.
+*/
+type AdminPeersReply struct {
+	Peers []PeerStatus `json:"peers"`
+}
+
+/*
+	A file registered on the Server by one Peer.
+*/
+type RegisteredFile struct {
+	PeerID int      `json:"peerId"`
+	Status string   `json:"status"`
+	Info   FileInfo `json:"info"`
+}
+
+/*
+	Reply to Admin.Files.
+*/
+type AdminFilesReply struct {
+	Files []RegisteredFile `json:"files"`
+}
+
+/*
+	Reply to Admin.Ping: how many of the connection attempts
+	to the Peer succeeded.
+*/
+type AdminPingReply struct {
+	PeerID    int    `json:"peerId"`
+	Addr      string `json:"addr"`
+	Attempts  int    `json:"attempts"`
+	Successes int    `json:"successes"`
+	Live      bool   `json:"live"`
+}
+
+/*
+	Reply to Admin.Discover: the files the Peer says it shares.
+*/
+type AdminDiscoverReply struct {
+	PeerID int        `json:"peerId"`
+	Files  []FileInfo `json:"files"`
+}
+
+/*
+	Reply to Admin.Evict: the Peer and its files were removed
+	from the registry.
+*/
+type AdminEvictReply struct {
+	PeerID   int `json:"peerId"`
+	NumFiles int `json:"numFiles"`
+}
+
+/*
+	A join token issued by the Server. The secret part of
+	the token is only ever returned by Admin.IssueToken.
+*/
+type TokenInfo struct {
+	ID      string    `json:"id"`
+	User    string    `json:"user"`
+	Created time.Time `json:"created"`
+	Revoked bool      `json:"revoked"`
+}
+
+/*
+	Reply to Admin.Tokens.
+*/
+type AdminTokensReply struct {
+	Tokens []TokenInfo `json:"tokens"`
+}
+
+/*
+	Arguments of Admin.IssueToken.
+*/
+type AdminIssueArgs struct {
+	User string
+}
+
+/*
+	Reply to Admin.IssueToken. Token is what the Peer
+	is started with.
+*/
+type AdminIssueReply struct {
+	Info  TokenInfo `json:"info"`
+	Token string    `json:"token"`
+}
+
+/*
+	Arguments of Admin.RevokeToken.
+*/
+type AdminRevokeArgs struct {
+	ID string
+}
+
+/*
+	Reply to Admin.RevokeToken: the token, and how many Peers
+	that joined with it were marked offline.
+*/
+type AdminRevokeReply struct {
+	Info     TokenInfo `json:"info"`
+	NumPeers int       `json:"numPeers"`
+}
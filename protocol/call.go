@@ -0,0 +1,192 @@
+/*
+	This file contains the helpers both sides use to make RPCs. Calls
+	never abort the program: they return a *CallError saying which call
+	to which address failed and why. Every attempt has a deadline, and
+	calls that failed because the other side could not be reached or
+	did not answer the dial in time are retried with exponential
+	backoff. Once the request was sent a failure is not retried: the
+	call may have taken effect, e.g. issued a token.
+*/
+
+package protocol
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/rpc"
+	"strings"
+	"time"
+)
+
+/*
+	How long one attempt of a call may take, dialing included.
+*/
+const CallTimeout = 10 * time.Second
+
+/*
+	How many times a call is attempted, and how long to wait
+	before the first retry. The wait doubles after each retry.
+*/
+const CallAttempts = 3
+const RetryBackoff = 250 * time.Millisecond
+
+/*
+	Reasons a call fails without the remote handler returning an
+	error. Both are transient, so calls failing with them are retried
+	if the request was not sent yet.
+*/
+var (
+	ErrUnreachable = errors.New("unreachable")
+	ErrTimeout     = errors.New("timed out")
+)
+
+/*
+	Returned by every failed call. Err is ErrUnreachable or ErrTimeout
+	(wrapped with the underlying cause), or the error the remote
+	handler returned.
+*/
+type CallError struct {
+	Method string
+	Addr   string
+	Err    error
+}
+
+func (e *CallError) Error() string {
+	return fmt.Sprintf("%v to %v: %v", e.Method, e.Addr, e.Err)
+}
+
+func (e *CallError) Unwrap() error {
+	return e.Err
+}
+
+/*
+	Returns true if err is worth retrying: the other side could not
+	be reached, dropped the connection or did not answer in time.
+*/
+func Temporary(err error) bool {
+	return errors.Is(err, ErrUnreachable) || errors.Is(err, ErrTimeout)
+}
+
+/*
+	Calls method on the RPC server at addr, retrying transient
+	failures to connect. Each attempt dials a new connection.
+*/
+func Call(ctx context.Context, addr string, method string, args interface{}, reply interface{}) error {
+	backoff := RetryBackoff
+	for attempt := 1; ; attempt++ {
+		sent, err := callOnce(ctx, addr, method, args, reply)
+		if err == nil || sent || !Temporary(err) || attempt == CallAttempts {
+			return err
+		}
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return &CallError{method, addr, fmt.Errorf("%w: %v", ErrTimeout, ctx.Err())}
+		}
+		backoff *= 2
+	}
+}
+
+/*
+	Makes one attempt of a call. Returns true if the connection
+	was made, and so the request may have reached the server.
+*/
+func callOnce(ctx context.Context, addr string, method string, args interface{}, reply interface{}) (bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, CallTimeout)
+	defer cancel()
+
+	c, err := Dial(ctx, addr)
+	if err != nil {
+		return false, &CallError{method, addr, err}
+	}
+	defer c.Close()
+	return true, CallClient(ctx, c, addr, method, args, reply)
+}
+
+/*
+	Connects to the RPC server at addr over HTTP, like rpc.DialHTTP()
+	but giving up when ctx is done, and over TLS if it is enabled
+	(see tls.go), sending the token in ctx if there is one. Errors
+	wrap ErrUnreachable or ErrTimeout, except for a certificate the
+	other side presented being refused, or the token being refused.
+*/
+func Dial(ctx context.Context, addr string) (*rpc.Client, error) {
+	d := net.Dialer{}
+	conn, err := d.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, fmt.Errorf("%w: %v", ErrTimeout, err)
+		}
+		return nil, fmt.Errorf("%w: %v", ErrUnreachable, err)
+	}
+	if TLS != nil {
+		tlsConn := tls.Client(conn, clientTLS(ctx))
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			if ctx.Err() != nil {
+				return nil, fmt.Errorf("%w: %v", ErrTimeout, err)
+			}
+			if errors.Is(err, ErrCertificate) {
+				return nil, fmt.Errorf("TLS handshake: %w", err)
+			}
+			return nil, fmt.Errorf("%w: TLS handshake: %v", ErrUnreachable, err)
+		}
+		conn = tlsConn
+	}
+
+	// The handshake must not outlive ctx either.
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	header := "CONNECT " + rpc.DefaultRPCPath + " HTTP/1.0\n"
+	if token, _ := ctx.Value(tokenKey{}).(string); token != "" {
+		header += "Authorization: Bearer " + token + "\n"
+	}
+	io.WriteString(conn, header+"\n")
+	resp, err := http.ReadResponse(bufio.NewReader(conn), &http.Request{Method: "CONNECT"})
+	if err == nil && resp.StatusCode == http.StatusUnauthorized {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		conn.Close()
+		return nil, fmt.Errorf("%w: %v", ErrUnauthorized, strings.TrimSpace(string(body)))
+	}
+	if err == nil && resp.Status != "200 Connected to Go RPC" {
+		err = errors.New("unexpected HTTP response: " + resp.Status)
+	}
+	if err != nil {
+		conn.Close()
+		if ctx.Err() != nil {
+			return nil, fmt.Errorf("%w: %v", ErrTimeout, err)
+		}
+		return nil, fmt.Errorf("%w: %v", ErrUnreachable, err)
+	}
+	conn.SetDeadline(time.Time{})
+	return rpc.NewClient(conn), nil
+}
+
+/*
+	Calls method over an already dialed client, giving up when ctx
+	is done. addr is only used to describe errors.
+*/
+func CallClient(ctx context.Context, c *rpc.Client, addr string, method string, args interface{}, reply interface{}) error {
+	call := c.Go(method, args, reply, make(chan *rpc.Call, 1))
+	select {
+	case <-call.Done:
+	case <-ctx.Done():
+		return &CallError{method, addr, fmt.Errorf("%w: %v", ErrTimeout, ctx.Err())}
+	}
+	if call.Error == nil {
+		return nil
+	}
+	var serverErr rpc.ServerError
+	if errors.As(call.Error, &serverErr) {
+		return &CallError{method, addr, call.Error}
+	}
+	// rpc.ErrShutdown, io.ErrUnexpectedEOF...: the connection broke.
+	return &CallError{method, addr, fmt.Errorf("%w: %v", ErrUnreachable, call.Error)}
+}
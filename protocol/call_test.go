@@ -0,0 +1,79 @@
+package protocol
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/rpc"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+/*
+	An RPC service counting its calls, which answer
+	after delay.
+*/
+type slowService struct {
+	calls atomic.Int32
+	delay time.Duration
+}
+
+func (s *slowService) Issue(args *int, reply *int) error {
+	s.calls.Add(1)
+	time.Sleep(s.delay)
+	*reply = *args
+	return nil
+}
+
+func TestCallRetries(t *testing.T) {
+	// A call that was sent is not repeated when it times out.
+	service := &slowService{delay: 500 * time.Millisecond}
+	serv := rpc.NewServer()
+	serv.RegisterName("Slow", service)
+	mux := http.NewServeMux()
+	mux.Handle(rpc.DefaultRPCPath, NewHandler(serv, nil))
+	l, err := Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go http.Serve(l, mux)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	args, reply := 1, 0
+	err = Call(ctx, l.Addr().String(), "Slow.Issue", &args, &reply)
+	if !Temporary(err) {
+		t.Errorf("slow call returned %v, want a timeout", err)
+	}
+	time.Sleep(service.delay)
+	if n := service.calls.Load(); n != 1 {
+		t.Errorf("the call was made %v times, want once", n)
+	}
+
+	// A call that could not connect is.
+	refusing, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer refusing.Close()
+	var accepted atomic.Int32
+	go func() {
+		for {
+			conn, err := refusing.Accept()
+			if err != nil {
+				return
+			}
+			accepted.Add(1)
+			conn.Close()
+		}
+	}()
+	err = Call(context.Background(), refusing.Addr().String(), "Slow.Issue", &args, &reply)
+	if !Temporary(err) {
+		t.Errorf("call to a closed connection returned %v, want unreachable", err)
+	}
+	if n := accepted.Load(); n != CallAttempts {
+		t.Errorf("connected %v times, want %v", n, CallAttempts)
+	}
+}
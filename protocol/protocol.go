@@ -0,0 +1,411 @@
+/*
+	This package contains every RPC request/reply type exchanged between
+	the Server (tracker) and the Peers, the names of the RPC methods and
+	the protocol version. Both the client and the server import it so the
+	two sides can no longer drift apart.
+*/
+
+package protocol
+
+import (
+	"fmt"
+	"path"
+	"strings"
+	"time"
+)
+
+/*
+	Version of the wire protocol. It must be bumped whenever a change
+	makes old Peers and Servers unable to talk to each other.
+*/
+const Version = 13
+
+/*
+	Files are transferred between Peers in blocks of ChunkSize
+	bytes, requested one at a time by offset.
+*/
+const ChunkSize = 1 << 20
+
+/*
+	Names of the RPC methods served by the Server.
+*/
+const (
+	ServerConnectPeer = "Server.ConnectPeer"
+	ServerRegister    = "Server.Register"
+	ServerUnregister  = "Server.Unregister"
+	ServerSearchFile  = "Server.SearchFile"
+	ServerSearch      = "Server.Search"
+	ServerHeartbeat   = "Server.Heartbeat"
+	ServerDisconnect  = "Server.Disconnect"
+)
+
+/*
+	Names of the RPC methods served by the Peers.
+*/
+const (
+	PeerAcceptConnect = "Peer.AcceptConnect"
+	PeerServeFile     = "Peer.ServeFile"
+	PeerServeChunk    = "Peer.ServeChunk"
+	PeerListFiles     = "Peer.ListFileReply"
+)
+
+/*
+	Returns an error if a remote side speaks a protocol version
+	this build cannot talk to.
+*/
+func CheckVersion(remote int) error {
+	if remote != Version {
+		return fmt.Errorf("incompatible protocol version %v, expected %v", remote, Version)
+	}
+	return nil
+}
+
+/*
+	Request RPC for Peer's to connect. Identity is the
+	persistent identifier a Peer keeps across restarts.
+	Port is the address the Peer listens on, and Host the
+	host other Peers should dial it on, if it is not the
+	address the Peer connects to the Server from.
+	OneShot is set by commands that run once and do not
+	listen (e.g. "peer fetch"): the Server then keeps the
+	address and liveness of the Peer as they were.
+	RemoteAddr, CertName (the name on the Peer's certificate,
+	with TLS), User and TokenID (the user and ID of the Peer's
+	join token) are filled in by the Server from the connection
+	the request arrived on; whatever the Peer sends is ignored.
+*/
+type ConnectRequest struct {
+	Version    int
+	PeerID     int
+	Identity   string
+	Port       string
+	Host       string
+	OneShot    bool
+	RemoteAddr string
+	CertName   string
+	User       string
+	TokenID    string
+}
+
+/*
+	Reply RPC for Peer's to connect. Returning is true when the
+	Server already knew the Peer's Identity, in which case PeerID
+	is the one it had before and Files the names it still has
+	registered for it.
+*/
+type ConnectReply struct {
+	Version   int
+	PeerID    int
+	Accepted  bool
+	Lease     time.Duration
+	Returning bool
+	Files     []string
+}
+
+/*
+	Sent periodically by a Peer to the Server with
+	Server.Heartbeat() to renew its lease. A Peer that
+	does not renew its lease before it runs out is
+	considered gone and its files are no longer returned
+	by searches. CertName, User and TokenID are filled in
+	by the Server, see ConnectRequest.
+*/
+type HeartbeatArgs struct {
+	PeerID   int
+	CertName string
+	User     string
+	TokenID  string
+}
+
+/*
+	Reply to HeartbeatArgs. Accepted is false if the
+	Server does not know the Peer.
+*/
+type HeartbeatReply struct {
+	Accepted bool
+	Lease    time.Duration
+}
+
+/*
+	Sent by a Peer to the Server with Server.Disconnect()
+	when it shuts down, so the Server stops returning its
+	files right away instead of when its lease runs out.
+	CertName and User are filled in by the Server, see ConnectRequest.
+*/
+type DisconnectArgs struct {
+	PeerID   int
+	CertName string
+	User     string
+}
+
+/*
+	Reply to DisconnectArgs. Accepted is false if the
+	Server does not know the Peer.
+*/
+type DisconnectReply struct {
+	Accepted bool
+}
+
+/*
+	Metadata describing one copy of a shared file. Hash is the
+	SHA-256 of the whole file and ChunkHashes the SHA-256 of each
+	ChunkSize block, all hex encoded.
+*/
+type FileInfo struct {
+	Name        string    `json:"name"`
+	Size        int64     `json:"size"`
+	Hash        string    `json:"hash"`
+	ChunkHashes []string  `json:"chunkHashes"`
+	ModTime     time.Time `json:"modTime"`
+	MimeType    string    `json:"mimeType"`
+	Description string    `json:"description"`
+	Tags        []string  `json:"tags"`
+	Access      []string  `json:"access,omitempty"`
+	Encrypted   bool      `json:"encrypted,omitempty"`
+}
+
+/*
+	Returns true if the holder of the certificate named certName,
+	in the given groups, may find and download the file. Access
+	lists certificate names, and groups as "@group"; a file without
+	Access is public. Only certificates are checked, so restricted
+	files can only be shared with TLS.
+*/
+func (f FileInfo) Allows(certName string, groups []string) bool {
+	if len(f.Access) == 0 {
+		return true
+	}
+	for _, entry := range f.Access {
+		group, isGroup := strings.CutPrefix(entry, "@")
+		if !isGroup && certName != "" && entry == certName {
+			return true
+		}
+		for _, g := range groups {
+			if isGroup && g == group {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+/*
+	Formats the access list of a file the way Peers type it in
+	publish, followed by "(encrypted)" for an encrypted share.
+*/
+func (f FileInfo) FormatAccess() string {
+	access := ""
+	if len(f.Access) > 0 {
+		access = "+" + strings.Join(f.Access, " +")
+	}
+	if f.Encrypted {
+		access = strings.TrimSpace(access + " (encrypted)")
+	}
+	return access
+}
+
+/*
+	Formats the tags of a file the way Peers type them in publish.
+*/
+func (f FileInfo) FormatTags() string {
+	if len(f.Tags) == 0 {
+		return ""
+	}
+	return "#" + strings.Join(f.Tags, " #")
+}
+
+/*
+	Returns true if name can be registered: a relative path using
+	"/" as separator, such as "notes.txt" or "project/src/main.go",
+	that stays inside the directory it is resolved against.
+*/
+func ValidName(name string) bool {
+	if name == "" || strings.HasPrefix(name, "/") || strings.Contains(name, "\\") {
+		return false
+	}
+	if path.Clean(name) != name || name == "." || name == ".." || strings.HasPrefix(name, "../") {
+		return false
+	}
+	return true
+}
+
+/*
+	RPC for a Peer to send a file to the server.
+	CertName and User are filled in by the Server, see ConnectRequest.
+*/
+type PeerSendFile struct {
+	PeerID   int
+	FileName string
+	Info     FileInfo
+	CertName string
+	User     string
+}
+
+/*
+	RPC for the server to confirm it received the file.
+*/
+type ServerReceiveFile struct {
+	FileName string
+	Received bool
+	Accepted bool
+}
+
+/*
+	Sent by the Peer to the Server when searching for
+	a file in the network using Peer.SearchForFile(), and
+	to another Peer to download it with Peer.ServeFile().
+	CertName and Groups, from the certificate of the sender,
+	are filled in by the receiver, see ConnectRequest.
+*/
+type RequestFileArgs struct {
+	PeerID   int
+	File     string
+	CertName string
+	Groups   []string
+}
+
+/*
+	Used by a peer to tell another Peer the size of a file in
+	Peer.openSource() and Peer.ServeFile(), before the contents
+	are fetched chunk by chunk. Load is the number of other
+	Peers the holder is currently sending chunks to.
+*/
+type RequestFileReply struct {
+	PeerID       int
+	FileExists   bool
+	ErrorMessage string
+	File         string
+	Size         int64
+	Load         int
+}
+
+/*
+	Sent by a Peer to fetch the ChunkSize bytes of a file
+	starting at Offset, using Peer.ServeChunk(). CertName
+	and Groups are filled in as in RequestFileArgs.
+*/
+type RequestChunkArgs struct {
+	PeerID   int
+	File     string
+	Offset   int64
+	CertName string
+	Groups   []string
+}
+
+/*
+	Reply to RequestChunkArgs. Data is shorter than ChunkSize
+	only for the last chunk of the file.
+*/
+type RequestChunkReply struct {
+	FileExists   bool
+	ErrorMessage string
+	File         string
+	Offset       int64
+	Data         []byte
+}
+
+/*
+	Sent by the Server to a Peer indicating the details
+	regarding a Peer that possesses a particular file. Used
+	in Peer.SearchForFile() and Server.SearchFile().
+	Addr holds, for each Peer, the host:port it can be dialed on
+	and Info the metadata of its copy. When File names a directory
+	Dir is true and there is one entry per file under it and Peer
+	holding it, with the file's full name in Info. With TLS, Names
+	holds the name on each Peer's certificate, which the Peer must
+	present when dialed.
+*/
+type FindPeerReply struct {
+	PeerID []int
+	Addr   []string
+	Names  []string
+	Info   []FileInfo
+	File   string
+	Found  bool
+	Dir    bool
+}
+
+/*
+	Returns the certificate name of the i-th Peer, or "" when
+	the Server did not send one.
+*/
+func (r *FindPeerReply) HolderName(i int) string {
+	if i < len(r.Names) {
+		return r.Names[i]
+	}
+	return ""
+}
+
+/*
+	Sent by the Server to a Peer to list the files in its
+	local repository (discover). CertName and Groups are
+	filled in as in RequestFileArgs.
+*/
+type RequestListFile struct {
+	PeerID   int
+	CertName string
+	Groups   []string
+}
+
+/*
+	Reply to RequestListFile.
+*/
+type ListFileReply struct {
+	File     []string
+	Info     []FileInfo
+	PeerID   int
+	NumFiles int
+	Accepted bool
+}
+
+/*
+	How the Query of a SearchArgs is matched against file names.
+	All modes are case-insensitive.
+*/
+const (
+	MatchSubstring = "substring"
+	MatchGlob      = "glob"
+	MatchRegex     = "regex"
+)
+
+/*
+	Sent by a Peer to the Server to search the registered files
+	using Server.Search(). Zero-valued filters are ignored. Page
+	numbers start at 1. CertName and Groups are filled in as in
+	RequestFileArgs.
+*/
+type SearchArgs struct {
+	PeerID   int
+	CertName string
+	Groups   []string
+	Query    string
+	Mode     string
+	MinSize  int64
+	MaxSize  int64
+	MimeType string
+	Tag      string
+	Page     int
+	PageSize int
+}
+
+/*
+	One distinct file content found by Server.Search(). Names lists
+	every name the content is registered under and Holders the
+	number of Peers holding it.
+*/
+type SearchResult struct {
+	Info    FileInfo `json:"info"`
+	Names   []string `json:"names"`
+	Holders int      `json:"holders"`
+}
+
+/*
+	Reply to SearchArgs, holding one page of results.
+*/
+type SearchReply struct {
+	Results  []SearchResult `json:"results"`
+	Total    int            `json:"total"`
+	Page     int            `json:"page"`
+	PageSize int            `json:"pageSize"`
+	NumPages int            `json:"numPages"`
+}
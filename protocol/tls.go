@@ -0,0 +1,298 @@
+/*
+	This file contains the optional TLS layer of every connection.
+	A small certificate authority (CA) issues one certificate per
+	Peer, and one named TrackerName to the Server. When TLS is
+	enabled both ends of a connection present a certificate signed
+	by the CA, and a side that dials checks that the other one holds
+	the certificate it expects by name: the Server's, or the one the
+	Peer was registered with. Host names are not checked, since Peers
+	are dialed on whatever address the Server saw them connect from.
+*/
+
+package protocol
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+/*
+	Name of the certificate the Server holds.
+*/
+const TrackerName = "tracker"
+
+/*
+	Files of the certificate authority, in its directory.
+*/
+const (
+	CACertFile = "ca.crt"
+	CAKeyFile  = "ca.key"
+)
+
+/*
+	How long the CA and the certificates it issues are valid.
+*/
+const caValidity = 10 * 365 * 24 * time.Hour
+const certValidity = 2 * 365 * 24 * time.Hour
+
+/*
+	The certificate and CA used for every connection made or
+	accepted by this process, or nil to use plain TCP. Set once
+	at start up with LoadTLS().
+*/
+var TLS *tls.Config
+
+/*
+	Loads the CA certificate, and the certificate and key of this
+	process, into a config that requires a certificate signed by
+	the CA from the other side of every connection.
+*/
+func LoadTLS(caFile string, certFile string, keyFile string) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("loading certificate: %v", err)
+	}
+	data, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, fmt.Errorf("loading CA certificate: %v", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no certificate found in %v", caFile)
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		RootCAs:      pool,
+		ClientCAs:    pool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		MinVersion:   tls.VersionTLS12,
+	}, nil
+}
+
+/*
+	Wrapped by the errors of dials that refused the certificate
+	the other side presented. These are not retried.
+*/
+var ErrCertificate = errors.New("certificate refused")
+
+type nameKey struct{}
+
+/*
+	Returns a context for calls that only accept a certificate
+	with the given name from the side they dial. Without a name
+	any certificate signed by the CA is accepted.
+*/
+func ExpectName(ctx context.Context, name string) context.Context {
+	return context.WithValue(ctx, nameKey{}, name)
+}
+
+/*
+	Returns the config to dial with, checking the certificate
+	of the other side against the CA and the name in ctx.
+*/
+func clientTLS(ctx context.Context) *tls.Config {
+	name, _ := ctx.Value(nameKey{}).(string)
+	conf := TLS.Clone()
+	// The chain and the name are checked below instead.
+	conf.InsecureSkipVerify = true
+	conf.VerifyConnection = func(cs tls.ConnectionState) error {
+		if len(cs.PeerCertificates) == 0 {
+			return fmt.Errorf("%w: no certificate presented", ErrCertificate)
+		}
+		intermediates := x509.NewCertPool()
+		for _, cert := range cs.PeerCertificates[1:] {
+			intermediates.AddCert(cert)
+		}
+		opts := x509.VerifyOptions{
+			Roots:         TLS.RootCAs,
+			Intermediates: intermediates,
+			KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		}
+		if _, err := cs.PeerCertificates[0].Verify(opts); err != nil {
+			return fmt.Errorf("%w: %v", ErrCertificate, err)
+		}
+		if got := cs.PeerCertificates[0].Subject.CommonName; name != "" && got != name {
+			return fmt.Errorf("%w: it is for %q, expected %q", ErrCertificate, got, name)
+		}
+		return nil
+	}
+	return conf
+}
+
+/*
+	Returns the name and groups on the certificate the other side
+	of conn presented, or nothing for a plain TCP connection.
+*/
+func certIdentity(conn net.Conn) (string, []string) {
+	tlsConn, ok := conn.(*tls.Conn)
+	if !ok {
+		return "", nil
+	}
+	certs := tlsConn.ConnectionState().PeerCertificates
+	if len(certs) == 0 {
+		return "", nil
+	}
+	return certs[0].Subject.CommonName, certs[0].Subject.OrganizationalUnit
+}
+
+/*
+	Listens on addr, with TLS if it is enabled.
+*/
+func Listen(addr string) (net.Listener, error) {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	if TLS == nil {
+		return l, nil
+	}
+	return tls.NewListener(l, TLS), nil
+}
+
+/*
+	Creates a new CA in dir. An existing CA is never overwritten.
+*/
+func NewCA(dir string) error {
+	if _, err := os.Stat(filepath.Join(dir, CAKeyFile)); err == nil {
+		return fmt.Errorf("%v already holds a CA", dir)
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	template, err := certTemplate("FileSharing CA", caValidity)
+	if err != nil {
+		return err
+	}
+	template.IsCA = true
+	template.BasicConstraintsValid = true
+	template.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageCRLSign
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return err
+	}
+	return writeKeyPair(filepath.Join(dir, CACertFile), filepath.Join(dir, CAKeyFile), der, key)
+}
+
+/*
+	Issues a certificate named name, in the given groups (see
+	FileInfo.Allows()), signed by the CA in dir, and writes it to
+	outDir as name.crt and name.key, along with a copy of the CA
+	certificate. Returns the path of the certificate.
+*/
+func IssueCert(dir string, name string, groups []string, outDir string) (string, error) {
+	if !validCertName(name) {
+		return "", fmt.Errorf("invalid certificate name %q", name)
+	}
+	for _, group := range groups {
+		if !validCertName(group) {
+			return "", fmt.Errorf("invalid group name %q", group)
+		}
+	}
+	caCert, caKey, err := loadCA(dir)
+	if err != nil {
+		return "", err
+	}
+	if err := os.MkdirAll(outDir, 0700); err != nil {
+		return "", err
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return "", err
+	}
+	template, err := certTemplate(name, certValidity)
+	if err != nil {
+		return "", err
+	}
+	// Every Peer both serves and dials, and so does the Server.
+	template.KeyUsage = x509.KeyUsageDigitalSignature
+	template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth}
+	template.DNSNames = []string{name}
+	template.Subject.OrganizationalUnit = groups
+	der, err := x509.CreateCertificate(rand.Reader, template, caCert, &key.PublicKey, caKey)
+	if err != nil {
+		return "", err
+	}
+
+	certFile := filepath.Join(outDir, name+".crt")
+	if err := writeKeyPair(certFile, filepath.Join(outDir, name+".key"), der, key); err != nil {
+		return "", err
+	}
+	caPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: caCert.Raw})
+	if err := os.WriteFile(filepath.Join(outDir, CACertFile), caPEM, 0644); err != nil {
+		return "", err
+	}
+	return certFile, nil
+}
+
+/*
+	Returns true if name can be used for a certificate or a group:
+	a single path component, which cannot be confused with the
+	"@group" and "+name" syntax of access lists.
+*/
+func validCertName(name string) bool {
+	return ValidName(name) && !strings.ContainsAny(name, "/@+ ")
+}
+
+func certTemplate(name string, validity time.Duration) (*x509.Certificate, error) {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+	return &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(validity),
+	}, nil
+}
+
+func loadCA(dir string) (*x509.Certificate, *ecdsa.PrivateKey, error) {
+	pair, err := tls.LoadX509KeyPair(filepath.Join(dir, CACertFile), filepath.Join(dir, CAKeyFile))
+	if err != nil {
+		return nil, nil, fmt.Errorf("loading CA: %v", err)
+	}
+	cert, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return nil, nil, err
+	}
+	key, ok := pair.PrivateKey.(*ecdsa.PrivateKey)
+	if !ok {
+		return nil, nil, fmt.Errorf("unsupported CA key")
+	}
+	return cert, key, nil
+}
+
+/*
+	Writes a certificate and its private key as PEM. The key
+	is only readable by its owner.
+*/
+func writeKeyPair(certFile string, keyFile string, der []byte, key *ecdsa.PrivateKey) error {
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return err
+	}
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	if err := os.WriteFile(keyFile, keyPEM, 0600); err != nil {
+		return err
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	return os.WriteFile(certFile, certPEM, 0644)
+}
@@ -0,0 +1,96 @@
+package protocol
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net/http"
+	"net/rpc"
+	"path/filepath"
+	"testing"
+)
+
+/*
+	Creates a CA in dir and issues a certificate for each name,
+	returning their configs by name.
+*/
+func makeConfigs(t *testing.T, dir string, names ...string) map[string]*tls.Config {
+	t.Helper()
+	ca := filepath.Join(dir, "ca")
+	if err := NewCA(ca); err != nil {
+		t.Fatal(err)
+	}
+	confs := map[string]*tls.Config{}
+	for _, name := range names {
+		if _, err := IssueCert(ca, name, nil, dir); err != nil {
+			t.Fatal(err)
+		}
+		conf, err := LoadTLS(filepath.Join(dir, CACertFile), filepath.Join(dir, name+".crt"), filepath.Join(dir, name+".key"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		confs[name] = conf
+	}
+	return confs
+}
+
+/*
+	Starts an RPC server presenting the certificate of conf
+	and returns its address.
+*/
+func serveAs(t *testing.T, conf *tls.Config) string {
+	t.Helper()
+	TLS = conf
+	l, err := Listen("127.0.0.1:0")
+	TLS = nil
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	mux := http.NewServeMux()
+	mux.Handle(rpc.DefaultRPCPath, NewHandler(rpc.NewServer(), nil))
+	go http.Serve(l, mux)
+	return l.Addr().String()
+}
+
+func TestExpectName(t *testing.T) {
+	confs := makeConfigs(t, t.TempDir(), TrackerName, "alice", "bob")
+	// Signed by another CA, with the same names.
+	other := makeConfigs(t, t.TempDir(), TrackerName, "alice")
+
+	tracker := serveAs(t, confs[TrackerName])
+	bob := serveAs(t, confs["bob"])
+	fake := serveAs(t, other[TrackerName])
+
+	cases := []struct {
+		name   string
+		client *tls.Config
+		addr   string
+		expect string
+		ok     bool
+	}{
+		{"the tracker", confs["alice"], tracker, TrackerName, true},
+		{"a Peer posing as the tracker", confs["alice"], bob, TrackerName, false},
+		{"a tracker of another CA", confs["alice"], fake, TrackerName, false},
+		{"the registered Peer", confs["alice"], bob, "bob", true},
+		{"another certificate than the registered one", confs["alice"], tracker, "bob", false},
+		{"any certificate of the CA", confs["alice"], bob, "", true},
+		{"a client of another CA", other["alice"], tracker, TrackerName, false},
+	}
+	for _, c := range cases {
+		TLS = c.client
+		ctx := ExpectName(context.Background(), c.expect)
+		client, err := Dial(ctx, c.addr)
+		TLS = nil
+		if err == nil {
+			client.Close()
+		}
+		if (err == nil) != c.ok {
+			t.Errorf("%v: dial returned %v, want ok %v", c.name, err, c.ok)
+		}
+		// A server with the wrong certificate is refused for good.
+		if err != nil && c.client == confs["alice"] && (!errors.Is(err, ErrCertificate) || Temporary(err)) {
+			t.Errorf("%v: dial returned %v, want %v", c.name, err, ErrCertificate)
+		}
+	}
+}
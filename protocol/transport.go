@@ -0,0 +1,217 @@
+/*
+	This file contains the transport RPCs are served over. It is the
+	usual net/rpc over HTTP, so it is dialed with Dial() (or
+	rpc.DialHTTP() without TLS), but each connection gets its own codec
+	which remembers where the connection came from: the address, the
+	name and groups on the certificate presented with TLS, and the
+	user and ID of the join token sent with the CONNECT request. Requests that implement
+	stamped get them filled in, so handlers learn the real address
+	and the authenticated names of the caller.
+
+	A server given an Authenticator refuses connections whose
+	token it does not accept before any RPC is read.
+*/
+
+package protocol
+
+import (
+	"bufio"
+	"context"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/rpc"
+	"strings"
+)
+
+/*
+	Who sent a request, as known from its connection.
+*/
+type caller struct {
+	remoteAddr string
+	certName   string
+	groups     []string
+	user       string
+	tokenID    string
+}
+
+/*
+	Implemented by requests filled in with what is known of the
+	caller from the connection they arrive on. Whatever the sender
+	put in these fields is overwritten.
+*/
+type stamped interface {
+	stamp(c *caller)
+}
+
+func (r *ConnectRequest) stamp(c *caller) {
+	r.RemoteAddr = c.remoteAddr
+	r.CertName = c.certName
+	r.User = c.user
+	r.TokenID = c.tokenID
+}
+
+func (r *PeerSendFile) stamp(c *caller) {
+	r.CertName = c.certName
+	r.User = c.user
+}
+
+func (r *HeartbeatArgs) stamp(c *caller) {
+	r.CertName = c.certName
+	r.User = c.user
+	r.TokenID = c.tokenID
+}
+
+func (r *DisconnectArgs) stamp(c *caller) {
+	r.CertName = c.certName
+	r.User = c.user
+}
+
+func (r *RequestFileArgs) stamp(c *caller) {
+	r.CertName = c.certName
+	r.Groups = c.groups
+}
+
+func (r *RequestChunkArgs) stamp(c *caller) {
+	r.CertName = c.certName
+	r.Groups = c.groups
+}
+
+func (r *RequestListFile) stamp(c *caller) {
+	r.CertName = c.certName
+	r.Groups = c.groups
+}
+
+func (r *SearchArgs) stamp(c *caller) {
+	r.CertName = c.certName
+	r.Groups = c.groups
+}
+
+/*
+	Checks the join token a connection was made with ("" if
+	none was sent) and returns the user it was issued to
+	and its ID.
+*/
+type Authenticator func(token string) (user string, tokenID string, err error)
+
+/*
+	Wrapped by the errors of dials whose token was refused.
+	These are not retried.
+*/
+var ErrUnauthorized = errors.New("not authorized")
+
+type tokenKey struct{}
+
+/*
+	Returns a context for calls that send token with the
+	connections they make. Only give it to calls to the Server.
+*/
+func WithToken(ctx context.Context, token string) context.Context {
+	return context.WithValue(ctx, tokenKey{}, token)
+}
+
+/*
+	Returns a handler serving server's RPCs over HTTP CONNECT
+	like rpc.Server.ServeHTTP(), with a codec that stamps requests.
+	If auth is not nil, connections it refuses get a 401 reply.
+*/
+func NewHandler(server *rpc.Server, auth Authenticator) http.Handler {
+	return rpcHandler{server, auth}
+}
+
+type rpcHandler struct {
+	server *rpc.Server
+	auth   Authenticator
+}
+
+func (h rpcHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "CONNECT" {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		io.WriteString(w, "405 must CONNECT\n")
+		return
+	}
+	user, tokenID := "", ""
+	if h.auth != nil {
+		token := strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer ")
+		var err error
+		if user, tokenID, err = h.auth(token); err != nil {
+			fmt.Printf("Refused RPC connection from %v: %v\n", req.RemoteAddr, err)
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+	}
+	conn, _, err := w.(http.Hijacker).Hijack()
+	if err != nil {
+		fmt.Printf("Error accepting RPC connection from %v: %v\n", req.RemoteAddr, err)
+		return
+	}
+	io.WriteString(conn, "HTTP/1.0 200 Connected to Go RPC\n\n")
+	h.server.ServeCodec(newStampCodec(conn, user, tokenID))
+}
+
+/*
+	A gob rpc.ServerCodec, the same as net/rpc's own, that
+	stamps the requests implementing stamped.
+*/
+type stampCodec struct {
+	conn     net.Conn
+	caller   caller
+	dec      *gob.Decoder
+	enc      *gob.Encoder
+	encBuf   *bufio.Writer
+	closed   bool
+}
+
+func newStampCodec(conn net.Conn, user string, tokenID string) *stampCodec {
+	buf := bufio.NewWriter(conn)
+	name, groups := certIdentity(conn)
+	return &stampCodec{
+		conn:     conn,
+		caller:   caller{conn.RemoteAddr().String(), name, groups, user, tokenID},
+		dec:      gob.NewDecoder(conn),
+		enc:      gob.NewEncoder(buf),
+		encBuf:   buf,
+	}
+}
+
+func (c *stampCodec) ReadRequestHeader(r *rpc.Request) error {
+	return c.dec.Decode(r)
+}
+
+func (c *stampCodec) ReadRequestBody(body interface{}) error {
+	if err := c.dec.Decode(body); err != nil {
+		return err
+	}
+	if request, ok := body.(stamped); ok {
+		request.stamp(&c.caller)
+	}
+	return nil
+}
+
+func (c *stampCodec) WriteResponse(r *rpc.Response, body interface{}) error {
+	if err := c.enc.Encode(r); err != nil {
+		if c.encBuf.Flush() == nil {
+			c.Close()
+		}
+		return err
+	}
+	if err := c.enc.Encode(body); err != nil {
+		if c.encBuf.Flush() == nil {
+			c.Close()
+		}
+		return err
+	}
+	return c.encBuf.Flush()
+}
+
+func (c *stampCodec) Close() error {
+	if c.closed {
+		return nil
+	}
+	c.closed = true
+	return c.conn.Close()
+}
@@ -0,0 +1,259 @@
+/*
+	This file contains the Server's admin endpoint. It serves the
+	Admin RPCs on its own address (loopback only by default) so that
+	a running Server can be inspected and managed by the "tracker"
+	admin commands (see cli.go). The same functions back the
+	Server's own prompt.
+*/
+
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"net/rpc"
+	"sort"
+	"time"
+
+	"github.com/junvalentine/FileSharing/protocol"
+)
+
+/*
+	Number of connections PingPeer() attempts.
+*/
+const pingAttempts = 3
+
+/*
+	RPC receiver for the admin endpoint.
+*/
+type Admin struct {
+	m *Server
+}
+
+/*
+	Starts the admin endpoint on listen. With TLS only the
+	Server's own certificate is accepted, so the admin commands
+	must run with the Server's configuration.
+*/
+func (m *Server) adminServer(listen string) error {
+	serv := rpc.NewServer()
+	serv.Register(&Admin{m})
+	mux := http.NewServeMux()
+	mux.Handle(rpc.DefaultRPCPath, serv)
+
+	l, err := net.Listen("tcp", listen)
+	if err != nil {
+		return err
+	}
+	if protocol.TLS != nil {
+		conf := protocol.TLS.Clone()
+		conf.VerifyConnection = func(cs tls.ConnectionState) error {
+			if len(cs.PeerCertificates) == 0 || cs.PeerCertificates[0].Subject.CommonName != protocol.TrackerName {
+				return fmt.Errorf("the admin endpoint only accepts the %v certificate", protocol.TrackerName)
+			}
+			return nil
+		}
+		l = tls.NewListener(l, conf)
+	}
+	m.admin = l
+	go http.Serve(l, mux)
+	return nil
+}
+
+func unknownPeer(peerID int) error {
+	return fmt.Errorf("%v %v", protocol.UnknownPeer, peerID)
+}
+
+/*
+	Returns the status of a Peer. The caller must hold m.mu.
+*/
+func (pi *PeerInfo) status() string {
+	if pi.isConnected {
+		return protocol.StatusOnline
+	} else if pi.restored {
+		return protocol.StatusUnverified
+	}
+	return protocol.StatusOffline
+}
+
+/*
+	Returns every Peer known to the Server, by PeerID.
+*/
+func (m *Server) peerStatuses() []protocol.PeerStatus {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	peers := make([]protocol.PeerStatus, 0, len(m.peers))
+	for _, peerID := range m.peerIDs() {
+		pi := m.peers[peerID]
+		peers = append(peers, protocol.PeerStatus{
+			PeerID:   pi.PeerID,
+			Identity: pi.Identity,
+			Addr:     pi.Addr,
+			CertName: pi.CertName,
+			User:     pi.User,
+			Status:   pi.status(),
+			LastSeen: pi.lastSeen,
+			NumFiles: len(pi.Files),
+		})
+	}
+	return peers
+}
+
+/*
+	Returns every registered file, by name then PeerID.
+*/
+func (m *Server) registeredFiles() []protocol.RegisteredFile {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	names := make([]string, 0, len(m.byName))
+	for name := range m.byName {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	files := []protocol.RegisteredFile{}
+	for _, name := range names {
+		holders := make([]int, 0, len(m.byName[name]))
+		for peerID := range m.byName[name] {
+			holders = append(holders, peerID)
+		}
+		sort.Ints(holders)
+		for _, peerID := range holders {
+			pi := m.peers[peerID]
+			files = append(files, protocol.RegisteredFile{PeerID: peerID, Status: pi.status(), Info: pi.Files[name]})
+		}
+	}
+	return files
+}
+
+/*
+	Tries to open a connection to a Peer pingAttempts times.
+*/
+func (m *Server) ping(peerID int) (protocol.AdminPingReply, error) {
+	reply := protocol.AdminPingReply{PeerID: peerID, Attempts: pingAttempts}
+	addr, ok := m.peerAddr(peerID)
+	if !ok {
+		return reply, unknownPeer(peerID)
+	}
+	reply.Addr = addr
+	for i := 0; i < pingAttempts; i++ {
+		conn, err := net.DialTimeout("tcp", addr, pingTimeout)
+		if err != nil {
+			continue
+		}
+		conn.Close()
+		reply.Successes++
+	}
+	reply.Live = reply.Successes > 0
+	return reply, nil
+}
+
+/*
+	Asks a Peer for the files in its repository.
+*/
+func (m *Server) discover(peerID int) (protocol.AdminDiscoverReply, error) {
+	reply := protocol.AdminDiscoverReply{PeerID: peerID}
+	m.mu.Lock()
+	pi := m.findPeer(peerID)
+	if pi == nil {
+		m.mu.Unlock()
+		return reply, unknownPeer(peerID)
+	}
+	addr, name := pi.Addr, pi.CertName
+	m.mu.Unlock()
+
+	request := protocol.RequestListFile{}
+	list := protocol.ListFileReply{}
+	ctx := protocol.ExpectName(context.Background(), name)
+	if err := protocol.Call(ctx, addr, protocol.PeerListFiles, &request, &list); err != nil {
+		return reply, err
+	}
+	for i := 0; i < list.NumFiles && i < len(list.File); i++ {
+		info := protocol.FileInfo{Name: list.File[i]}
+		if i < len(list.Info) {
+			info = list.Info[i]
+		}
+		reply.Files = append(reply.Files, info)
+	}
+	return reply, nil
+}
+
+/*
+	Removes a Peer and its files from the registry. If the Peer is
+	still running, its next heartbeat is refused and it connects
+	again as a new Peer.
+*/
+func (m *Server) evict(peerID int) (protocol.AdminEvictReply, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	reply := protocol.AdminEvictReply{PeerID: peerID}
+	pi := m.findPeer(peerID)
+	if pi == nil {
+		return reply, unknownPeer(peerID)
+	}
+	reply.NumFiles = len(pi.Files)
+	m.removePeer(pi)
+	m.persist(logRecord{Op: opEvict, PeerID: peerID})
+	fmt.Printf("Evicted Peer %v and its %v files\n", peerID, reply.NumFiles)
+	return reply, nil
+}
+
+func (a *Admin) Peers(request *protocol.AdminArgs, reply *protocol.AdminPeersReply) error {
+	reply.Peers = a.m.peerStatuses()
+	return nil
+}
+
+func (a *Admin) Files(request *protocol.AdminArgs, reply *protocol.AdminFilesReply) error {
+	reply.Files = a.m.registeredFiles()
+	return nil
+}
+
+func (a *Admin) Ping(request *protocol.AdminPeerArgs, reply *protocol.AdminPingReply) error {
+	r, err := a.m.ping(request.PeerID)
+	*reply = r
+	return err
+}
+
+func (a *Admin) Discover(request *protocol.AdminPeerArgs, reply *protocol.AdminDiscoverReply) error {
+	r, err := a.m.discover(request.PeerID)
+	*reply = r
+	return err
+}
+
+func (a *Admin) Evict(request *protocol.AdminPeerArgs, reply *protocol.AdminEvictReply) error {
+	r, err := a.m.evict(request.PeerID)
+	*reply = r
+	return err
+}
+
+func (a *Admin) Tokens(request *protocol.AdminArgs, reply *protocol.AdminTokensReply) error {
+	reply.Tokens = a.m.tokenInfos()
+	return nil
+}
+
+func (a *Admin) IssueToken(request *protocol.AdminIssueArgs, reply *protocol.AdminIssueReply) error {
+	r, err := a.m.issueToken(request.User)
+	*reply = r
+	return err
+}
+
+func (a *Admin) RevokeToken(request *protocol.AdminRevokeArgs, reply *protocol.AdminRevokeReply) error {
+	r, err := a.m.revokeToken(request.ID)
+	*reply = r
+	return err
+}
+
+/*
+	Calls an admin RPC on the Server at addr.
+*/
+func adminCall(addr string, rpcname string, args interface{}, reply interface{}) error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	return protocol.Call(protocol.ExpectName(ctx, protocol.TrackerName), addr, rpcname, args, reply)
+}
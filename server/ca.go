@@ -0,0 +1,70 @@
+/*
+	This file contains the "ca" command, a small certificate authority
+	for running the Server and the Peers with TLS (see protocol/tls.go):
+		tracker ca init [-dir ca]
+			creates the CA in dir
+		tracker ca issue [-dir ca] [-out dir] [-groups a,b] <name>
+			issues the certificate of a Peer named name, in the
+			given groups, or the Server's when name is "tracker",
+			into out
+	The CA key never leaves dir: each Peer is only given its own
+	certificate and key and the CA certificate.
+*/
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/junvalentine/FileSharing/protocol"
+)
+
+const caUsage = "usage: tracker ca init [-dir ca] | tracker ca issue [-dir ca] [-out dir] [-groups a,b] <name>"
+
+func runCA(args []string) (interface{}, error) {
+	if len(args) == 0 {
+		return nil, fail(exitUsage, caUsage)
+	}
+	fs := flag.NewFlagSet("ca "+args[0], flag.ContinueOnError)
+	dir := fs.String("dir", "ca", "directory of the CA")
+	out := fs.String("out", ".", "directory the certificate is written to")
+	groupList := fs.String("groups", "", "comma-separated groups the certificate is in")
+	if err := fs.Parse(args[1:]); err != nil {
+		return nil, fail(exitUsage, "%v", err)
+	}
+
+	switch args[0] {
+	case "init":
+		if fs.NArg() != 0 {
+			return nil, fail(exitUsage, caUsage)
+		}
+		if err := protocol.NewCA(*dir); err != nil {
+			return nil, err
+		}
+		fmt.Printf("Created a CA in %v, issue the Server's certificate with: tracker ca issue %v\n", *dir, protocol.TrackerName)
+		return map[string]string{"ca": filepath.Join(*dir, protocol.CACertFile)}, nil
+	case "issue":
+		if fs.NArg() != 1 {
+			return nil, fail(exitUsage, caUsage)
+		}
+		name := fs.Arg(0)
+		groups := []string{}
+		for _, group := range strings.Split(*groupList, ",") {
+			if group = strings.TrimSpace(group); group != "" {
+				groups = append(groups, group)
+			}
+		}
+		certFile, err := protocol.IssueCert(*dir, name, groups, *out)
+		if err != nil {
+			return nil, err
+		}
+		keyFile := strings.TrimSuffix(certFile, ".crt") + ".key"
+		caFile := filepath.Join(*out, protocol.CACertFile)
+		fmt.Printf("Issued %v: start with -ca %v -cert %v -key %v\n", name, caFile, certFile, keyFile)
+		return map[string]interface{}{"name": name, "groups": groups, "ca": caFile, "cert": certFile, "key": keyFile}, nil
+	}
+	return nil, fail(exitUsage, caUsage)
+}
@@ -0,0 +1,312 @@
+/*
+	This file contains the Server's non-interactive commands. "serve"
+	runs the Server without its prompt, e.g. as a background service.
+	The other commands are admin commands: they talk to the admin
+	endpoint of a running Server (see admin.go) and exit with one of
+	the exit codes below, so they can be scripted:
+		serve             run the Server until interrupted
+		peers             list the Peers
+		files             list the registered files
+		ping <PeerID>     check that a Peer is reachable
+		discover <PeerID> list the files in a Peer's repository
+		evict <PeerID>    remove a Peer and its files from the registry
+		ca init|issue     manage the TLS certificates (see ca.go)
+		token list|issue|revoke
+		                  manage the join tokens (see tokens.go)
+	With -json the result of the command is printed on stdout as JSON.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/junvalentine/FileSharing/protocol"
+)
+
+const usage = `Usage: tracker [flags] [command]
+
+Without a command the Server starts with an interactive prompt. Commands:
+  serve               run the Server until interrupted, without a prompt
+  peers               list the Peers of a running Server
+  files               list the files registered on a running Server
+  ping <PeerID>       check that a Peer is reachable
+  discover <PeerID>   list the files in a Peer's repository
+  evict <PeerID>      remove a Peer and its files from the registry
+  ca init             create a certificate authority in -dir (default ca)
+  ca issue <name>     issue a certificate named name, "tracker" for the Server,
+                      in the groups given with -groups
+  token list          list the join tokens issued by a running Server
+  token issue <user>  issue a join token to user, printed once
+  token revoke <ID>   revoke a join token
+
+The admin commands talk to the Server's admin endpoint (-admin).
+With TLS (-ca, -cert, -key) the Server, the Peers and the admin
+commands all need a certificate issued by the same CA, and the admin
+commands the Server's own.
+
+Flags:
+`
+
+/*
+	Exit codes of the commands.
+*/
+const (
+	exitOK          = 0
+	exitFailure     = 1
+	exitUsage       = 2
+	exitNotFound    = 3
+	exitUnreachable = 4
+)
+
+/*
+	An error a command failed with, and the exit code it maps to.
+*/
+type commandError struct {
+	code int
+	err  error
+}
+
+func (e *commandError) Error() string {
+	return e.err.Error()
+}
+
+func fail(code int, format string, args ...interface{}) error {
+	return &commandError{code, fmt.Errorf(format, args...)}
+}
+
+/*
+	Returns the exit code for an error returned by a command.
+*/
+func exitCode(err error) int {
+	var cmdErr *commandError
+	if errors.As(err, &cmdErr) {
+		return cmdErr.code
+	}
+	if protocol.Temporary(err) {
+		return exitUnreachable
+	}
+	if strings.Contains(err.Error(), protocol.UnknownPeer) || strings.Contains(err.Error(), protocol.UnknownToken) {
+		return exitNotFound
+	}
+	return exitFailure
+}
+
+/*
+	Runs the command in args and returns the exit code.
+*/
+func runCommand(conf Config, args []string) int {
+	jsonOut := conf.JSON
+	rest := []string{}
+	for _, arg := range args[1:] {
+		if arg == "-json" || arg == "--json" {
+			jsonOut = true
+		} else {
+			rest = append(rest, arg)
+		}
+	}
+
+	out := os.Stdout
+	if jsonOut {
+		os.Stdout = os.Stderr
+	}
+
+	var result interface{}
+	var err error
+	switch args[0] {
+	case "serve":
+		err = runServe(conf, rest)
+	case "peers":
+		result, err = runPeers(conf, rest)
+	case "files":
+		result, err = runFiles(conf, rest)
+	case "ping":
+		result, err = runPing(conf, rest)
+	case "discover":
+		result, err = runDiscover(conf, rest)
+	case "evict":
+		result, err = runEvict(conf, rest)
+	case "ca":
+		result, err = runCA(rest)
+	case "token":
+		result, err = runToken(conf, rest)
+	default:
+		err = fail(exitUsage, "unknown command %q, see tracker -h", args[0])
+	}
+
+	// A command can fail with a result, e.g. ping when the
+	// Peer is not live: the result is printed instead of the error.
+	if jsonOut && result != nil {
+		writeJSON(out, result)
+	}
+	if err != nil {
+		if jsonOut && result == nil {
+			writeJSON(out, map[string]interface{}{"error": err.Error(), "code": exitCode(err)})
+		} else if !jsonOut {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		}
+		return exitCode(err)
+	}
+	return exitOK
+}
+
+func writeJSON(w io.Writer, v interface{}) {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
+
+/*
+	Parses the PeerID argument of an admin command.
+*/
+func peerArg(command string, args []string) (protocol.AdminPeerArgs, error) {
+	if len(args) != 1 {
+		return protocol.AdminPeerArgs{}, fail(exitUsage, "usage: tracker %v <PeerID>", command)
+	}
+	peerID, err := strconv.Atoi(args[0])
+	if err != nil {
+		return protocol.AdminPeerArgs{}, fail(exitUsage, "invalid PeerID %q", args[0])
+	}
+	return protocol.AdminPeerArgs{PeerID: peerID}, nil
+}
+
+func noArgs(command string, args []string) error {
+	if len(args) != 0 {
+		return fail(exitUsage, "usage: tracker %v", command)
+	}
+	return nil
+}
+
+/*
+	Runs the Server without the prompt, until the process
+	is interrupted.
+*/
+func runServe(conf Config, args []string) error {
+	if err := noArgs("serve", args); err != nil {
+		return err
+	}
+	m := MakeServer(conf.Listen, conf.Data, conf.Admin, conf.Secret)
+	m.Welcome()
+	fmt.Printf("Serving on %v, admin endpoint on %v, press Ctrl-C to stop\n", conf.Listen, conf.Admin)
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	<-sig
+	fmt.Printf("Server shutting down\n")
+	m.Shutdown()
+	return nil
+}
+
+func runPeers(conf Config, args []string) (interface{}, error) {
+	if err := noArgs("peers", args); err != nil {
+		return nil, err
+	}
+	reply := protocol.AdminPeersReply{}
+	if err := adminCall(conf.Admin, protocol.AdminPeers, &protocol.AdminArgs{}, &reply); err != nil {
+		return nil, err
+	}
+	printPeers(reply.Peers)
+	return reply, nil
+}
+
+func runFiles(conf Config, args []string) (interface{}, error) {
+	if err := noArgs("files", args); err != nil {
+		return nil, err
+	}
+	reply := protocol.AdminFilesReply{}
+	if err := adminCall(conf.Admin, protocol.AdminFiles, &protocol.AdminArgs{}, &reply); err != nil {
+		return nil, err
+	}
+	printFiles(reply.Files)
+	return reply, nil
+}
+
+/*
+	Pings a Peer from the Server. Fails with exitUnreachable
+	if the Peer did not answer.
+*/
+func runPing(conf Config, args []string) (interface{}, error) {
+	request, err := peerArg("ping", args)
+	if err != nil {
+		return nil, err
+	}
+	reply := protocol.AdminPingReply{}
+	if err := adminCall(conf.Admin, protocol.AdminPing, &request, &reply); err != nil {
+		return nil, err
+	}
+	printPing(reply)
+	if !reply.Live {
+		return reply, fail(exitUnreachable, "Peer %v at %v is not reachable", reply.PeerID, reply.Addr)
+	}
+	return reply, nil
+}
+
+func runDiscover(conf Config, args []string) (interface{}, error) {
+	request, err := peerArg("discover", args)
+	if err != nil {
+		return nil, err
+	}
+	reply := protocol.AdminDiscoverReply{}
+	if err := adminCall(conf.Admin, protocol.AdminDiscover, &request, &reply); err != nil {
+		return nil, err
+	}
+	printDiscover(reply)
+	return reply, nil
+}
+
+func runEvict(conf Config, args []string) (interface{}, error) {
+	request, err := peerArg("evict", args)
+	if err != nil {
+		return nil, err
+	}
+	reply := protocol.AdminEvictReply{}
+	if err := adminCall(conf.Admin, protocol.AdminEvict, &request, &reply); err != nil {
+		return nil, err
+	}
+	fmt.Printf("Evicted Peer %v and its %v files\n", reply.PeerID, reply.NumFiles)
+	return reply, nil
+}
+
+/*
+	Lists, issues or revokes join tokens on a running Server.
+*/
+func runToken(conf Config, args []string) (interface{}, error) {
+	const tokenUsage = "usage: tracker token list | tracker token issue <user> | tracker token revoke <ID>"
+	if len(args) == 0 {
+		return nil, fail(exitUsage, tokenUsage)
+	}
+	switch {
+	case args[0] == "list" && len(args) == 1:
+		reply := protocol.AdminTokensReply{}
+		if err := adminCall(conf.Admin, protocol.AdminTokens, &protocol.AdminArgs{}, &reply); err != nil {
+			return nil, err
+		}
+		printTokens(reply.Tokens)
+		return reply, nil
+	case args[0] == "issue" && len(args) == 2:
+		request := protocol.AdminIssueArgs{User: args[1]}
+		reply := protocol.AdminIssueReply{}
+		if err := adminCall(conf.Admin, protocol.AdminIssue, &request, &reply); err != nil {
+			return nil, err
+		}
+		fmt.Printf("Issued token %v to %v, start the Peer with: -token %v\n", reply.Info.ID, reply.Info.User, reply.Token)
+		return reply, nil
+	case args[0] == "revoke" && len(args) == 2:
+		request := protocol.AdminRevokeArgs{ID: args[1]}
+		reply := protocol.AdminRevokeReply{}
+		if err := adminCall(conf.Admin, protocol.AdminRevoke, &request, &reply); err != nil {
+			return nil, err
+		}
+		fmt.Printf("Revoked token %v of %v, %v Peers marked offline\n", reply.Info.ID, reply.Info.User, reply.NumPeers)
+		return reply, nil
+	}
+	return nil, fail(exitUsage, tokenUsage)
+}
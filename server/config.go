@@ -0,0 +1,162 @@
+/*
+	This file contains the Server configuration and the functions used
+	to load it. Every setting can come from four places, in increasing
+	order of precedence:
+		1. built-in defaults
+		2. an optional JSON config file (-config or FS_CONFIG)
+		3. environment variables (FS_LISTEN, FS_DATA, FS_ADMIN,
+		   FS_CA, FS_CERT, FS_KEY, FS_SECRET)
+		4. command-line flags (-listen, -data, -admin, -ca, -cert, -key, -secret)
+*/
+
+package main
+
+import (
+	"crypto/x509"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/junvalentine/FileSharing/protocol"
+)
+
+/*
+	Settings used to start the Server.
+*/
+type Config struct {
+	Listen string `json:"listen"`
+	Data   string `json:"data"`
+	Admin  string `json:"admin"`
+	CA     string `json:"ca"`
+	Cert   string `json:"cert"`
+	Key    string `json:"key"`
+	Secret string `json:"secret"`
+	JSON   bool   `json:"-"`
+}
+
+/*
+	Returns the configuration used when nothing else is provided.
+*/
+func DefaultConfig() Config {
+	return Config{
+		Listen: ":1337",
+		Data:   "tracker-data",
+		Admin:  "127.0.0.1:1338",
+	}
+}
+
+/*
+	Builds the Server configuration from the defaults, the config file,
+	the environment and the given command-line arguments. Returns
+	the arguments left after the flags: the command to run, if any.
+*/
+func LoadConfig(args []string) (Config, []string, error) {
+	conf := DefaultConfig()
+
+	fs := flag.NewFlagSet("tracker", flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprint(fs.Output(), usage)
+		fs.PrintDefaults()
+	}
+	configFile := fs.String("config", os.Getenv("FS_CONFIG"), "path to a JSON config file")
+	listen := fs.String("listen", "", "address or port the Server listens on")
+	data := fs.String("data", "", "directory the registry is persisted in")
+	admin := fs.String("admin", "", "address of the admin endpoint, served by the Server and used by the admin commands")
+	ca := fs.String("ca", "", "CA certificate; with -cert and -key, enables TLS")
+	cert := fs.String("cert", "", "certificate of this Server, issued by the CA")
+	key := fs.String("key", "", "private key of the certificate")
+	secret := fs.String("secret", "", "shared secret Peers may join with, instead of a token")
+	fs.BoolVar(&conf.JSON, "json", false, "print the result of an admin command as JSON")
+	if err := fs.Parse(args); err != nil {
+		return conf, nil, err
+	}
+
+	if *configFile != "" {
+		if err := conf.readFile(*configFile); err != nil {
+			return conf, nil, err
+		}
+	}
+
+	overrideString(&conf.Listen, os.Getenv("FS_LISTEN"))
+	overrideString(&conf.Data, os.Getenv("FS_DATA"))
+	overrideString(&conf.Admin, os.Getenv("FS_ADMIN"))
+	overrideString(&conf.CA, os.Getenv("FS_CA"))
+	overrideString(&conf.Cert, os.Getenv("FS_CERT"))
+	overrideString(&conf.Key, os.Getenv("FS_KEY"))
+	overrideString(&conf.Secret, os.Getenv("FS_SECRET"))
+
+	overrideString(&conf.Listen, *listen)
+	overrideString(&conf.Data, *data)
+	overrideString(&conf.Admin, *admin)
+	overrideString(&conf.CA, *ca)
+	overrideString(&conf.Cert, *cert)
+	overrideString(&conf.Key, *key)
+	overrideString(&conf.Secret, *secret)
+
+	conf.normalize()
+	if err := conf.loadTLS(); err != nil {
+		return conf, nil, err
+	}
+	return conf, fs.Args(), nil
+}
+
+/*
+	Reads a JSON config file on top of the current settings.
+	Fields missing from the file keep their current value.
+*/
+func (c *Config) readFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("reading config file: %v", err)
+	}
+	if err := json.Unmarshal(data, c); err != nil {
+		return fmt.Errorf("parsing config file %v: %v", path, err)
+	}
+	return nil
+}
+
+/*
+	Accepts a bare port for Listen, and for Admin, where it
+	means that port on the loopback interface.
+*/
+func (c *Config) normalize() {
+	if c.Listen != "" && !strings.Contains(c.Listen, ":") {
+		c.Listen = ":" + c.Listen
+	}
+	if c.Admin != "" && !strings.Contains(c.Admin, ":") {
+		c.Admin = "127.0.0.1:" + c.Admin
+	}
+}
+
+/*
+	Enables TLS when the CA, certificate and key are all set.
+*/
+func (c *Config) loadTLS() error {
+	if c.CA == "" && c.Cert == "" && c.Key == "" {
+		return nil
+	}
+	if c.CA == "" || c.Cert == "" || c.Key == "" {
+		return fmt.Errorf("TLS needs the CA, the certificate and the key")
+	}
+	conf, err := protocol.LoadTLS(c.CA, c.Cert, c.Key)
+	if err != nil {
+		return err
+	}
+	leaf, err := x509.ParseCertificate(conf.Certificates[0].Certificate[0])
+	if err != nil {
+		return fmt.Errorf("parsing %v: %v", c.Cert, err)
+	}
+	if name := leaf.Subject.CommonName; name != protocol.TrackerName {
+		return fmt.Errorf("the Server needs the %q certificate, %v is for %q", protocol.TrackerName, c.Cert, name)
+	}
+	protocol.TLS = conf
+	return nil
+}
+
+func overrideString(dst *string, value string) {
+	if value != "" {
+		*dst = value
+	}
+}
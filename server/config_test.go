@@ -0,0 +1,47 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLoadConfig(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "tracker.json")
+	os.WriteFile(file, []byte(`{"listen": "9000", "data": "file-data", "admin": "file:1"}`), 0644)
+
+	cases := []struct {
+		name   string
+		env    map[string]string
+		args   []string
+		listen string
+		data   string
+		admin  string
+		rest   []string
+	}{
+		{"defaults", nil, nil, ":1337", "tracker-data", "127.0.0.1:1338", nil},
+		{"file over defaults", nil, []string{"-config", file}, ":9000", "file-data", "file:1", nil},
+		{"environment over file", map[string]string{"FS_CONFIG": file, "FS_DATA": "env-data", "FS_ADMIN": "2000"}, nil, ":9000", "env-data", "127.0.0.1:2000", nil},
+		{"flags over environment", map[string]string{"FS_CONFIG": file, "FS_DATA": "env-data", "FS_ADMIN": "2000"}, []string{"-data", "flag-data", "peers"}, ":9000", "flag-data", "127.0.0.1:2000", []string{"peers"}},
+		{"flags over defaults", nil, []string{"-listen", "host:1", "-admin", "host:2"}, "host:1", "tracker-data", "host:2", nil},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			for _, name := range []string{"FS_CONFIG", "FS_LISTEN", "FS_DATA", "FS_ADMIN", "FS_CA", "FS_CERT", "FS_KEY", "FS_SECRET"} {
+				t.Setenv(name, c.env[name])
+			}
+			conf, rest, err := LoadConfig(c.args)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if conf.Listen != c.listen || conf.Data != c.data || conf.Admin != c.admin {
+				t.Errorf("got listen %q, data %q, admin %q, want %q, %q, %q", conf.Listen, conf.Data, conf.Admin, c.listen, c.data, c.admin)
+			}
+			if strings.Join(rest, " ") != strings.Join(c.rest, " ") {
+				t.Errorf("arguments left %q, want %q", rest, c.rest)
+			}
+		})
+	}
+}
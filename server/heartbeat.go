@@ -0,0 +1,102 @@
+/*
+	This file contains the Server's liveness tracking. Every Peer
+	holds a lease that it renews by sending heartbeats; a Peer whose
+	lease runs out, or that disconnects when it shuts down, is marked
+	offline and its files are left out of search results until it
+	connects again. Its late heartbeats are refused, which makes it
+	connect again. Peers loaded from the registry after a restart
+	only need to send a heartbeat.
+*/
+
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/junvalentine/FileSharing/protocol"
+)
+
+/*
+	How long a Peer stays online without sending a heartbeat.
+*/
+const leaseDuration = 30 * time.Second
+
+/*
+	RPC handler for the heartbeats Peers send to renew their lease.
+*/
+func (m *Server) Heartbeat(request *protocol.HeartbeatArgs, reply *protocol.HeartbeatReply) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	reply.Accepted = false
+	pi := m.findPeer(request.PeerID)
+	if pi == nil || !pi.authorized(request.CertName, request.User) {
+		return nil
+	}
+	if !pi.isConnected && !pi.restored {
+		fmt.Printf("Refused a heartbeat from Peer %v, it is offline\n", request.PeerID)
+		return nil
+	}
+	if !pi.isConnected {
+		fmt.Printf("Peer %v is back online\n", request.PeerID)
+	}
+	pi.tokenID = request.TokenID
+	pi.isConnected = true
+	pi.restored = false
+	pi.disconnected = false
+	m.markSeen(pi, nil)
+	reply.Accepted = true
+	reply.Lease = leaseDuration
+	return nil
+}
+
+/*
+	RPC handler for Peers shutting down. The Peer is marked
+	offline so its files are left out of search results; it
+	keeps its PeerID and files for when it connects again. This
+	is logged, so the Peer is still offline after a restart.
+*/
+func (m *Server) Disconnect(request *protocol.DisconnectArgs, reply *protocol.DisconnectReply) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	reply.Accepted = false
+	pi := m.findPeer(request.PeerID)
+	if pi == nil || !pi.authorized(request.CertName, request.User) {
+		return nil
+	}
+	pi.isConnected = false
+	pi.restored = false
+	pi.disconnected = true
+	m.markSeen(pi, &logRecord{Op: opDisconnect, PeerID: pi.PeerID})
+	reply.Accepted = true
+	fmt.Printf("Peer %v disconnected\n", request.PeerID)
+	return nil
+}
+
+/*
+	Marks Peers whose lease ran out as offline, forever.
+*/
+func (m *Server) expirePeers() {
+	for {
+		time.Sleep(leaseDuration / 6)
+
+		m.mu.Lock()
+		m.expireLeases(time.Now())
+		m.mu.Unlock()
+	}
+}
+
+/*
+	Marks Peers whose lease ran out by now as offline.
+	The caller must hold m.mu.
+*/
+func (m *Server) expireLeases(now time.Time) {
+	for _, pi := range m.peers {
+		if pi.isConnected && now.Sub(pi.lastSeen) > leaseDuration {
+			pi.isConnected = false
+			fmt.Printf("Peer %v missed its heartbeats, marking it offline\n", pi.PeerID)
+		}
+	}
+}
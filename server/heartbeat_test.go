@@ -0,0 +1,78 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/junvalentine/FileSharing/protocol"
+)
+
+/*
+	Returns the names of the files a search for query finds.
+*/
+func searchNames(t *testing.T, m *Server, query string) []string {
+	t.Helper()
+	request := protocol.SearchArgs{Query: query}
+	reply := protocol.SearchReply{}
+	if err := m.Search(&request, &reply); err != nil {
+		t.Fatal(err)
+	}
+	names := []string{}
+	for _, r := range reply.Results {
+		names = append(names, r.Names...)
+	}
+	return names
+}
+
+func sendHeartbeat(m *Server, peerID int) bool {
+	request := protocol.HeartbeatArgs{PeerID: peerID}
+	reply := protocol.HeartbeatReply{}
+	return m.Heartbeat(&request, &reply) == nil && reply.Accepted
+}
+
+func TestLeaseExpiry(t *testing.T) {
+	dir := t.TempDir()
+	m := openTestStore(t, dir)
+	a, b := connect(t, m, "a"), connect(t, m, "b")
+	register(t, m, a, "a.txt")
+	register(t, m, b, "b.txt")
+
+	// a was last seen a lease ago, b renewed its lease since.
+	now := time.Now()
+	m.peers[a].lastSeen = now.Add(-leaseDuration - time.Second)
+	m.peers[b].lastSeen = now.Add(-leaseDuration / 2)
+	m.expireLeases(now)
+	if m.peers[a].isConnected || !m.peers[b].isConnected {
+		t.Fatalf("after expiry: a connected %v, b connected %v", m.peers[a].isConnected, m.peers[b].isConnected)
+	}
+	if got, want := searchNames(t, m, ".txt"), []string{"b.txt"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("search found %q, want %q", got, want)
+	}
+
+	// The late heartbeat is refused until a connects again.
+	if sendHeartbeat(m, a) {
+		t.Errorf("a heartbeat after the lease ran out was accepted")
+	}
+	if !sendHeartbeat(m, b) || m.peers[a].isConnected {
+		t.Errorf("heartbeats of b refused, or a back online")
+	}
+	if connect(t, m, "a") != a || !sendHeartbeat(m, a) {
+		t.Errorf("a did not get its PeerID and lease back when connecting")
+	}
+	if got, want := searchNames(t, m, ".txt"), []string{"a.txt", "b.txt"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("search found %q, want %q", got, want)
+	}
+
+	// Peers loaded after a restart come back with a heartbeat.
+	m = crash(t, m, dir)
+	if len(searchNames(t, m, ".txt")) != 0 {
+		t.Errorf("restored Peers are searched before they heartbeat")
+	}
+	if !sendHeartbeat(m, a) {
+		t.Errorf("the heartbeat of a restored Peer was refused")
+	}
+	if got, want := searchNames(t, m, ".txt"), []string{"a.txt"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("search found %q, want %q", got, want)
+	}
+}
@@ -1,36 +1,64 @@
 package main
 
 import (
+	"flag"
 	"fmt"
 	"time"
 	"bufio"
+	"io"
 	"os"
+	"os/signal"
 	"strings"
 	"strconv"
+	"syscall"
 )
 
 func main() {
+	conf, args, err := LoadConfig(os.Args[1:])
+	if err == flag.ErrHelp {
+		os.Exit(0)
+	} else if err != nil {
+		fmt.Printf("Error loading configuration: %v\n", err)
+		os.Exit(2)
+	}
+	if len(args) > 0 {
+		os.Exit(runCommand(conf, args))
+	}
 
 	start := time.Now()
-	m := MakeServer()
+	m := MakeServer(conf.Listen, conf.Data, conf.Admin, conf.Secret)
 	t1 := time.Now()
 	elapsed := t1.Sub(start)
 
 	m.Welcome()
 	fmt.Printf("Total start time: %v\n", elapsed)
 	
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-sig
+		fmt.Printf("Server shutting down\n")
+		m.Shutdown()
+		os.Exit(0)
+	}()
+
+	reader := bufio.NewReader(os.Stdin)
 	for true {
 
 		fmt.Printf("\nPlease enter a command: \n")
 		fmt.Printf("1. discover [hostname/PeerID]\n")
 		fmt.Printf("2. ping [hostname/PeerID]\n")
 		fmt.Printf("3. list\n")
-		fmt.Printf("4. exit\n")
+		fmt.Printf("4. files\n")
+		fmt.Printf("5. evict [PeerID]\n")
+		fmt.Printf("6. exit\n")
 
-		var input string
-		reader := bufio.NewReader(os.Stdin)
-		input, _ = reader.ReadString('\n')
+		input, err := reader.ReadString('\n')
 		// fmt.Printf("You entered: %s", input)
+		if err == io.EOF && input == "" {
+			fmt.Printf("Server shutting down\n")
+			break
+		}
 
 		if len(input) < 4 {
 			fmt.Printf("Incorrect command\n")
@@ -52,6 +80,21 @@ func main() {
 			}
 		} else if input[:4] == "list"{
 			m.ListPeers()
+		} else if len(input) >= 5 && input[:5] == "files" {
+			m.ListFiles()
+		} else if len(input) >= 5 && input[:5] == "evict" {
+			words := strings.Split(input, " ")
+			
+			if len(words) != 2 {
+				fmt.Printf("Incorrect command\n")
+			} else {
+				peerID, err := strconv.Atoi(strings.TrimSpace(words[1]))
+				if err != nil {
+					fmt.Printf("Invalid PeerID")
+					continue
+				}
+				m.EvictPeer(peerID)
+			}
 		} else if len(input) >= 8 && input[:8] == "discover" {
 			words := strings.Split(input, " ")
 			
@@ -71,4 +114,5 @@ func main() {
 		}
 	}
 
+	m.Shutdown()
 }
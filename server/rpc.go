@@ -0,0 +1,40 @@
+/*
+	This file contains how the Server works out the address of a Peer.
+	The transport (see protocol/transport.go) stamps every ConnectRequest
+	with the address the connection came from, so the Server learns the
+	real address of each Peer.
+*/
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/junvalentine/FileSharing/protocol"
+)
+
+/*
+	Returns the host:port other Peers should dial a connecting Peer
+	on: the host it advertises, or else the host it connected from,
+	with the port it listens on. IPv6 hosts are bracketed.
+*/
+func peerAddress(request *protocol.ConnectRequest) (string, error) {
+	listenHost, port, err := net.SplitHostPort(request.Port)
+	if err != nil {
+		return "", fmt.Errorf("invalid listen address %q: %v", request.Port, err)
+	}
+
+	host := strings.Trim(request.Host, "[]")
+	if host == "" && request.RemoteAddr != "" {
+		host, _, err = net.SplitHostPort(request.RemoteAddr)
+		if err != nil {
+			return "", fmt.Errorf("invalid remote address %q: %v", request.RemoteAddr, err)
+		}
+	}
+	if host == "" {
+		host = listenHost
+	}
+	return net.JoinHostPort(host, port), nil
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/junvalentine/FileSharing/protocol"
+)
+
+func TestPeerAddress(t *testing.T) {
+	cases := []struct {
+		port       string
+		host       string
+		remoteAddr string
+		want       string
+	}{
+		{":8080", "", "192.168.1.5:50123", "192.168.1.5:8080"},
+		{"0.0.0.0:8080", "", "192.168.1.5:50123", "192.168.1.5:8080"},
+		{":8080", "", "[::1]:50123", "[::1]:8080"},
+		{":8080", "", "[fe80::1%eth0]:50123", "[fe80::1%eth0]:8080"},
+		{":8080", "peer.example.com", "192.168.1.5:50123", "peer.example.com:8080"},
+		{":8080", "10.0.0.7", "[::1]:50123", "10.0.0.7:8080"},
+		{":8080", "::1", "192.168.1.5:50123", "[::1]:8080"},
+		{":8080", "[2001:db8::1]", "192.168.1.5:50123", "[2001:db8::1]:8080"},
+		{"127.0.0.1:8080", "", "", "127.0.0.1:8080"},
+		{"[::1]:8080", "", "", "[::1]:8080"},
+		{":8080", "", "", ":8080"},
+	}
+	for _, c := range cases {
+		request := protocol.ConnectRequest{Port: c.port, Host: c.host, RemoteAddr: c.remoteAddr}
+		got, err := peerAddress(&request)
+		if err != nil || got != c.want {
+			t.Errorf("peerAddress(port %q, host %q, from %q) = %q, %v, want %q", c.port, c.host, c.remoteAddr, got, err, c.want)
+		}
+	}
+
+	invalid := []protocol.ConnectRequest{
+		{Port: "8080"},
+		{Port: "::1:8080"},
+		{Port: ":8080", RemoteAddr: "192.168.1.5"},
+	}
+	for _, request := range invalid {
+		if got, err := peerAddress(&request); err == nil {
+			t.Errorf("peerAddress(%+v) = %q, want an error", request, got)
+		}
+	}
+}
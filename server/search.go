@@ -0,0 +1,177 @@
+/*
+	This file contains the Server's search RPC handler. Unlike
+	SearchFile(), which needs the exact file name, Search() matches
+	names by substring, glob or regex, filters on size, MIME type and
+	tag, and groups the matches by content hash.
+*/
+
+package main
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/junvalentine/FileSharing/protocol"
+)
+
+const defaultPageSize = 20
+const maxPageSize = 100
+
+/*
+	Builds a case-insensitive name matcher for the query and mode
+	of a SearchArgs. A glob without '/' is matched against the base
+	name of files, since '*' does not match '/' and files published
+	in directories are named by their path.
+*/
+func nameMatcher(query string, mode string) (func(string) bool, error) {
+	query = strings.ToLower(query)
+	switch mode {
+	case "", protocol.MatchSubstring:
+		return func(name string) bool {
+			return strings.Contains(strings.ToLower(name), query)
+		}, nil
+	case protocol.MatchGlob:
+		if _, err := path.Match(query, ""); err != nil {
+			return nil, fmt.Errorf("invalid glob %q: %v", query, err)
+		}
+		return func(name string) bool {
+			name = strings.ToLower(name)
+			if !strings.Contains(query, "/") {
+				name = path.Base(name)
+			}
+			ok, _ := path.Match(query, name)
+			return ok
+		}, nil
+	case protocol.MatchRegex:
+		re, err := regexp.Compile("(?i)" + query)
+		if err != nil {
+			return nil, fmt.Errorf("invalid regex %q: %v", query, err)
+		}
+		return re.MatchString, nil
+	}
+	return nil, fmt.Errorf("unknown search mode %q", mode)
+}
+
+/*
+	Returns true if a file passes the size, type and tag filters
+	of a SearchArgs.
+*/
+func matchesFilters(info *protocol.FileInfo, request *protocol.SearchArgs) bool {
+	if request.MinSize > 0 && info.Size < request.MinSize {
+		return false
+	}
+	if request.MaxSize > 0 && info.Size > request.MaxSize {
+		return false
+	}
+	if request.MimeType != "" && !strings.HasPrefix(strings.ToLower(info.MimeType), strings.ToLower(request.MimeType)) {
+		return false
+	}
+	if request.Tag != "" {
+		for _, tag := range info.Tags {
+			if strings.EqualFold(tag, request.Tag) {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+/*
+	RPC handler for when a Peer searches the registered files.
+	Matching files are grouped by content hash, sorted by name and
+	returned one page at a time, along with the number of Peers
+	holding each of them. Each group shows the metadata of its
+	smallest name, from the lowest PeerID, so that results and
+	pages are the same from call to call. Copies the requester
+	is not allowed to access are left out.
+*/
+func (m *Server) Search(request *protocol.SearchArgs, reply *protocol.SearchReply) error {
+	match, err := nameMatcher(request.Query, request.Mode)
+	if err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	groups := map[string]*protocol.SearchResult{}
+	holders := map[string]map[int]bool{}
+	shownName := map[string]string{}
+	shownPeer := map[string]int{}
+	for name, peerIDs := range m.byName {
+		if !match(name) {
+			continue
+		}
+		for peerID := range peerIDs {
+			pi := m.peers[peerID]
+			info := pi.Files[name]
+			if !pi.isConnected || !matchesFilters(&info, request) || !pi.visible(&info, request.CertName, request.Groups) {
+				continue
+			}
+			group, ok := groups[info.Hash]
+			if !ok {
+				group = &protocol.SearchResult{Info: info}
+				groups[info.Hash] = group
+				holders[info.Hash] = map[int]bool{}
+				shownName[info.Hash], shownPeer[info.Hash] = name, pi.PeerID
+			} else if name < shownName[info.Hash] || (name == shownName[info.Hash] && pi.PeerID < shownPeer[info.Hash]) {
+				group.Info = info
+				shownName[info.Hash], shownPeer[info.Hash] = name, pi.PeerID
+			}
+			if !containsString(group.Names, name) {
+				group.Names = append(group.Names, name)
+			}
+			holders[info.Hash][pi.PeerID] = true
+		}
+	}
+	m.mu.Unlock()
+
+	results := make([]protocol.SearchResult, 0, len(groups))
+	for hash, group := range groups {
+		sort.Strings(group.Names)
+		group.Holders = len(holders[hash])
+		results = append(results, *group)
+	}
+	sort.Slice(results, func(a, b int) bool {
+		if results[a].Names[0] != results[b].Names[0] {
+			return results[a].Names[0] < results[b].Names[0]
+		}
+		return results[a].Info.Hash < results[b].Info.Hash
+	})
+
+	pageSize := request.PageSize
+	if pageSize <= 0 {
+		pageSize = defaultPageSize
+	} else if pageSize > maxPageSize {
+		pageSize = maxPageSize
+	}
+	reply.Total = len(results)
+	reply.PageSize = pageSize
+	reply.NumPages = (len(results) + pageSize - 1) / pageSize
+	reply.Page = request.Page
+	if reply.Page < 1 {
+		reply.Page = 1
+	}
+	start := (reply.Page - 1) * pageSize
+	if start < len(results) {
+		end := start + pageSize
+		if end > len(results) {
+			end = len(results)
+		}
+		reply.Results = results[start:end]
+	}
+
+	fmt.Printf("Peer %v searched for %q (%v results)\n", request.PeerID, request.Query, reply.Total)
+	return nil
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
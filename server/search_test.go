@@ -0,0 +1,160 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/junvalentine/FileSharing/protocol"
+)
+
+func TestNameMatcher(t *testing.T) {
+	cases := []struct {
+		query string
+		mode  string
+		name  string
+		want  bool
+	}{
+		{"note", "", "Notes.txt", true},
+		{"NOTE", protocol.MatchSubstring, "docs/notes.txt", true},
+		{"notes", protocol.MatchSubstring, "readme.md", false},
+		{"", protocol.MatchSubstring, "anything", true},
+		{"*.go", protocol.MatchGlob, "main.go", true},
+		{"*.go", protocol.MatchGlob, "project/src/main.go", true},
+		{"*.GO", protocol.MatchGlob, "project/Main.go", true},
+		{"*.go", protocol.MatchGlob, "main.go.bak", false},
+		{"project/*.go", protocol.MatchGlob, "project/main.go", true},
+		{"project/*.go", protocol.MatchGlob, "project/src/main.go", false},
+		{"project/*/*.go", protocol.MatchGlob, "project/src/main.go", true},
+		{"file-?.bin", protocol.MatchGlob, "file-1.bin", true},
+		{"file-[ab].bin", protocol.MatchGlob, "file-c.bin", false},
+		{`^notes\.txt$`, protocol.MatchRegex, "Notes.TXT", true},
+		{`^notes\.txt$`, protocol.MatchRegex, "docs/notes.txt", false},
+		{`\.(go|md)$`, protocol.MatchRegex, "project/readme.md", true},
+	}
+	for _, c := range cases {
+		match, err := nameMatcher(c.query, c.mode)
+		if err != nil {
+			t.Errorf("nameMatcher(%q, %q): %v", c.query, c.mode, err)
+			continue
+		}
+		if got := match(c.name); got != c.want {
+			t.Errorf("%v %q on %q = %v, want %v", c.mode, c.query, c.name, got, c.want)
+		}
+	}
+
+	invalid := []struct{ query, mode string }{
+		{"[", protocol.MatchGlob},
+		{"(", protocol.MatchRegex},
+		{"x", "fuzzy"},
+	}
+	for _, c := range invalid {
+		if _, err := nameMatcher(c.query, c.mode); err == nil {
+			t.Errorf("nameMatcher(%q, %q) succeeded, want an error", c.query, c.mode)
+		}
+	}
+}
+
+func TestMatchesFilters(t *testing.T) {
+	info := protocol.FileInfo{Size: 100, MimeType: "text/plain; charset=utf-8", Tags: []string{"Work", "notes"}}
+	cases := []struct {
+		request protocol.SearchArgs
+		want    bool
+	}{
+		{protocol.SearchArgs{}, true},
+		{protocol.SearchArgs{MinSize: 100}, true},
+		{protocol.SearchArgs{MinSize: 101}, false},
+		{protocol.SearchArgs{MaxSize: 100}, true},
+		{protocol.SearchArgs{MaxSize: 99}, false},
+		{protocol.SearchArgs{MinSize: 50, MaxSize: 150}, true},
+		{protocol.SearchArgs{MimeType: "text"}, true},
+		{protocol.SearchArgs{MimeType: "TEXT/PLAIN"}, true},
+		{protocol.SearchArgs{MimeType: "image"}, false},
+		{protocol.SearchArgs{Tag: "work"}, true},
+		{protocol.SearchArgs{Tag: "wor"}, false},
+		{protocol.SearchArgs{Tag: "notes", MaxSize: 10}, false},
+	}
+	for _, c := range cases {
+		if got := matchesFilters(&info, &c.request); got != c.want {
+			t.Errorf("matchesFilters(%+v) = %v, want %v", c.request, got, c.want)
+		}
+	}
+}
+
+func TestSearchPaging(t *testing.T) {
+	m := newServer()
+	pi := m.addPeer(1)
+	pi.isConnected = true
+	for i := 0; i < 25; i++ {
+		name := fmt.Sprintf("file-%02v.bin", i)
+		m.addFile(pi, name, protocol.FileInfo{Name: name, Hash: name})
+	}
+	// Another holder of file-00.bin, and a Peer that is offline.
+	other := m.addPeer(2)
+	other.isConnected = true
+	m.addFile(other, "file-00.bin", protocol.FileInfo{Name: "file-00.bin", Hash: "file-00.bin"})
+	offline := m.addPeer(3)
+	m.addFile(offline, "file-99.bin", protocol.FileInfo{Name: "file-99.bin", Hash: "file-99.bin"})
+
+	cases := []struct {
+		page, pageSize           int
+		wantPage, wantSize       int
+		wantResults, wantNumPage int
+		first                    string
+	}{
+		{0, 0, 1, defaultPageSize, 20, 2, "file-00.bin"},
+		{1, 10, 1, 10, 10, 3, "file-00.bin"},
+		{2, 0, 2, defaultPageSize, 5, 2, "file-20.bin"},
+		{3, 10, 3, 10, 5, 3, "file-20.bin"},
+		{4, 10, 4, 10, 0, 3, ""},
+		{-1, 1000, 1, maxPageSize, 25, 1, "file-00.bin"},
+	}
+	for _, c := range cases {
+		request := protocol.SearchArgs{Query: "file", Page: c.page, PageSize: c.pageSize}
+		reply := protocol.SearchReply{}
+		if err := m.Search(&request, &reply); err != nil {
+			t.Fatal(err)
+		}
+		if reply.Total != 25 || reply.Page != c.wantPage || reply.PageSize != c.wantSize || reply.NumPages != c.wantNumPage || len(reply.Results) != c.wantResults {
+			t.Errorf("page %v of %v: got total %v, page %v of %v, size %v, %v results", c.page, c.pageSize, reply.Total, reply.Page, reply.NumPages, reply.PageSize, len(reply.Results))
+			continue
+		}
+		if len(reply.Results) > 0 && reply.Results[0].Info.Name != c.first {
+			t.Errorf("page %v of %v starts with %v, want %v", c.page, c.pageSize, reply.Results[0].Info.Name, c.first)
+		}
+	}
+
+	request := protocol.SearchArgs{Query: "file-00.bin"}
+	reply := protocol.SearchReply{}
+	if err := m.Search(&request, &reply); err != nil {
+		t.Fatal(err)
+	}
+	if len(reply.Results) != 1 || reply.Results[0].Holders != 2 {
+		t.Errorf("file-00.bin: got %+v, want one result with 2 holders", reply.Results)
+	}
+
+	// One content under two names, from two Peers, sorts by its
+	// smallest name and shows the metadata of that copy.
+	m.addFile(other, "dup-z.txt", protocol.FileInfo{Name: "dup-z.txt", Hash: "dup", Description: "z"})
+	m.addFile(other, "dup-a.txt", protocol.FileInfo{Name: "dup-a.txt", Hash: "dup", Description: "other a"})
+	m.addFile(pi, "dup-a.txt", protocol.FileInfo{Name: "dup-a.txt", Hash: "dup", Description: "a"})
+	m.addFile(pi, "dup-m.txt", protocol.FileInfo{Name: "dup-m.txt", Hash: "m"})
+	for i := 0; i < 50; i++ {
+		pages := []string{}
+		for page := 1; page <= 2; page++ {
+			request := protocol.SearchArgs{Query: "dup", Page: page, PageSize: 1}
+			reply := protocol.SearchReply{}
+			if err := m.Search(&request, &reply); err != nil {
+				t.Fatal(err)
+			}
+			if len(reply.Results) != 1 {
+				t.Fatalf("page %v: got %+v", page, reply.Results)
+			}
+			r := reply.Results[0]
+			pages = append(pages, fmt.Sprintf("%v %v %q", r.Names, r.Holders, r.Info.Description))
+		}
+		if want := []string{`[dup-a.txt dup-z.txt] 2 "a"`, `[dup-m.txt] 1 ""`}; !reflect.DeepEqual(pages, want) {
+			t.Fatalf("call %v: got %q, want %q", i, pages, want)
+		}
+	}
+}
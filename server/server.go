@@ -5,40 +5,133 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"net"
 	"net/http"
 	"net/rpc"
+	"sort"
+	"strings"
 	"sync"
+	"time"
 
+	"github.com/junvalentine/FileSharing/protocol"
 )
 
+/*
+	How long PingPeer() waits for each connection.
+*/
+const pingTimeout = 2 * time.Second
+
 /*
 	Server data type for the server.
 */
 type Server struct {
-	peers    []PeerInfo
-	numPeers int
-	mu       sync.Mutex
+	peers      map[int]*PeerInfo
+	nextPeerID int
+	byIdentity map[string]int
+	byName     map[string]map[int]bool
+	byHash     map[string]map[fileKey]bool
+	store      *registryStore
+	listener   net.Listener
+	admin      net.Listener
+	tokens     *tokenStore
+	mu         sync.Mutex
+}
+
+/*
+	Returns an empty Server, with no listener.
+*/
+func newServer() *Server {
+	return &Server{
+		peers:      map[int]*PeerInfo{},
+		byIdentity: map[string]int{},
+		byName:     map[string]map[int]bool{},
+		byHash:     map[string]map[fileKey]bool{},
+	}
 }
 
 /*
 	RPC handler for when a Peer wishes to connect
-	to the Server.
+	to the Server. Peers speaking another protocol
+	version are turned away with an error. A Peer whose
+	Identity is already known gets its old PeerID back,
+	with its new address. The address other Peers are
+	given is the advertised host, or else the host the
+	Peer connected from, with the port it listens on.
+	With TLS an Identity is bound to the certificate it
+	first connected with, and with tokens to the user it
+	first joined as, and refused with any other. A one-shot
+	connection (see ConnectRequest) gets the Peer's PeerID
+	but changes neither its address nor its liveness, which
+	belong to the process serving the repository, if any.
 */
-func (m *Server) ConnectPeer(request *ConnectRequest, reply *ConnectReply) error {
+func (m *Server) ConnectPeer(request *protocol.ConnectRequest, reply *protocol.ConnectReply) error {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
+	reply.Version = protocol.Version
+	if err := protocol.CheckVersion(request.Version); err != nil {
+		reply.Accepted = false
+		fmt.Printf("Rejected Peer on %v: %v\n", request.Port, err)
+		return err
+	}
+
+	addr, err := peerAddress(request)
+	if err != nil {
+		reply.Accepted = false
+		fmt.Printf("Rejected Peer from %v: %v\n", request.RemoteAddr, err)
+		return err
+	}
+
 	reply.Accepted = true
-	reply.PeerID = m.numPeers
-	m.peers[m.numPeers].PeerID = m.numPeers
-	m.peers[m.numPeers].Port = request.Port
-	m.peers[m.numPeers].isConnected = true
-	fmt.Printf("Connected to Peer: %v\n", m.numPeers)
+	reply.Lease = leaseDuration
+	if peerID, ok := m.byIdentity[request.Identity]; ok && request.Identity != "" {
+		pi := m.peers[peerID]
+		if !pi.claimable(request.CertName, request.User) {
+			reply.Accepted = false
+			fmt.Printf("Rejected Peer %v: connected as %q/%q, but it is bound to %q/%q\n", pi.PeerID, request.CertName, request.User, pi.CertName, pi.User)
+			return fmt.Errorf("identity is bound to another certificate or user")
+		}
+		pi.CertName = request.CertName
+		pi.User = request.User
+		reply.PeerID = pi.PeerID
+		reply.Returning = true
+		reply.Files = pi.fileNames()
+		if request.OneShot {
+			m.persist(logRecord{Op: opConnect, PeerID: pi.PeerID, Identity: request.Identity, Addr: pi.Addr, CertName: pi.CertName, User: pi.User, OneShot: true})
+			fmt.Printf("Peer %v connected to run a command\n", pi.PeerID)
+			return nil
+		}
+		pi.Addr = addr
+		pi.tokenID = request.TokenID
+		pi.isConnected = true
+		pi.restored = false
+		pi.disconnected = false
+		m.markSeen(pi, &logRecord{Op: opConnect, PeerID: pi.PeerID, Identity: request.Identity, Addr: addr, CertName: pi.CertName, User: pi.User})
+		fmt.Printf("Reconnected to Peer: %v on %v\n", pi.PeerID, addr)
+		return nil
+	}
+
+	pi := m.addPeer(m.nextPeerID)
+	m.setIdentity(pi, request.Identity)
+	pi.CertName = request.CertName
+	pi.User = request.User
+	if request.OneShot {
+		// Offline, with no address, until it is served.
+		m.persist(logRecord{Op: opConnect, PeerID: pi.PeerID, Identity: request.Identity, CertName: pi.CertName, User: pi.User, OneShot: true})
+		fmt.Printf("Peer %v connected to run a command\n", pi.PeerID)
+		reply.PeerID = pi.PeerID
+		return nil
+	}
+	pi.Addr = addr
+	pi.tokenID = request.TokenID
+	pi.isConnected = true
+	m.markSeen(pi, &logRecord{Op: opConnect, PeerID: pi.PeerID, Identity: request.Identity, Addr: addr, CertName: pi.CertName, User: pi.User})
+	fmt.Printf("Connected to Peer: %v on %v\n", pi.PeerID, addr)
 
-	m.numPeers = m.numPeers + 1
+	reply.PeerID = pi.PeerID
 	return nil
 }
 
@@ -54,24 +147,58 @@ func (m *Server) Welcome() {
 	RPC handler for when a Peer registers a file in
 	the FileShare system to be shareable. This function will
 	update the Server's peers data to include the new
-	file.
+	file and its metadata (size, hashes, type, tags...).
+	Registering a name the Peer already shares replaces
+	the metadata of that file.
 */
-func (m *Server) Register(request *PeerSendFile, reply *ServerReceiveFile) error {
+func (m *Server) Register(request *protocol.PeerSendFile, reply *protocol.ServerReceiveFile) error {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
 	reply.Accepted = false
 	reply.FileName = request.FileName
 	reply.Received = true
-	for i := 0; i < m.numPeers; i++ {
-		if m.peers[i].PeerID == request.PeerID {
-			m.peers[i].Files[m.peers[i].numFiles] = request.FileName
-			m.peers[i].numFiles++
-			// m.peers[i].Fileloc[m.peers[i].numFiles] = request.location
-			reply.Accepted = true
-			fmt.Printf("Registered %v from Peer %v\n", request.FileName, request.PeerID)
-			break
-		}
+	pi := m.findPeer(request.PeerID)
+	if pi == nil {
+		return nil
+	}
+	if !pi.authorized(request.CertName, request.User) {
+		return errNotAuthorized
+	}
+	if !protocol.ValidName(request.FileName) {
+		fmt.Printf("Rejected file %q from Peer %v\n", request.FileName, request.PeerID)
+		return fmt.Errorf("invalid file name %q", request.FileName)
+	}
+	m.persist(logRecord{Op: opRegister, PeerID: request.PeerID, FileName: request.FileName, Info: &request.Info})
+	reply.Accepted = true
+	if m.addFile(pi, request.FileName, request.Info) {
+		fmt.Printf("Updated %v from Peer %v\n", request.FileName, request.PeerID)
+	} else {
+		fmt.Printf("Registered %v from Peer %v\n", request.FileName, request.PeerID)
+	}
+	return nil
+}
+
+/*
+	RPC handler for when a Peer withdraws a file it
+	registered earlier. The file is removed from the
+	Peer's file list so searches no longer return it.
+*/
+func (m *Server) Unregister(request *protocol.PeerSendFile, reply *protocol.ServerReceiveFile) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	reply.Accepted = false
+	reply.FileName = request.FileName
+	reply.Received = true
+	pi := m.findPeer(request.PeerID)
+	if pi != nil && !pi.authorized(request.CertName, request.User) {
+		return errNotAuthorized
+	}
+	if pi != nil && m.removeFile(pi, request.FileName) {
+		m.persist(logRecord{Op: opUnregister, PeerID: request.PeerID, FileName: request.FileName})
+		reply.Accepted = true
+		fmt.Printf("Unregistered %v from Peer %v\n", request.FileName, request.PeerID)
 	}
 	return nil
 }
@@ -79,68 +206,159 @@ func (m *Server) Register(request *PeerSendFile, reply *ServerReceiveFile) error
 /*
 	RPC handler for when a Peer is in search of a file.
 	This function will search the registered files in each
-	Peer's file list to find which Peer contains the requested
-	file. Then a FindPeerReply RPC will be sent to the requesting
+	Peer's file list to find which connected Peer contains the
+	requested file. Then a FindPeerReply RPC will be sent to the requesting
 	Peer telling it how to contact the Peer with the desired file.
+	If no file has the name, it is looked up as a directory. Copies
+	the requester is not allowed to access are left out.
 */
-func (m *Server) SearchFile(request *RequestFileArgs, reply *FindPeerReply) error {
+func (m *Server) SearchFile(request *protocol.RequestFileArgs, reply *protocol.FindPeerReply) error {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
 	reply.Found = false
 	reply.File = request.File
 	fmt.Printf("Peer %v requested a search for file %v\n", request.PeerID, request.File)
-	for i := 0; i < m.numPeers; i++ {
-		for j := 0; j < m.peers[i].numFiles; j++ {
-			if request.File == m.peers[i].Files[j] {
-				reply.Found = true
-				reply.PeerID = append(reply.PeerID,m.peers[i].PeerID)
-				reply.Port = append(reply.Port,m.peers[i].Port)
-				fmt.Printf("Found file %v for Peer %v on Peer %v\n", request.File, request.PeerID, m.peers[i].PeerID)
-			}
+	holders := make([]int, 0, len(m.byName[request.File]))
+	for peerID := range m.byName[request.File] {
+		holders = append(holders, peerID)
+	}
+	sort.Ints(holders)
+	for _, peerID := range holders {
+		pi := m.peers[peerID]
+		info := pi.Files[request.File]
+		if !pi.isConnected || !pi.visible(&info, request.CertName, request.Groups) {
+			continue
 		}
+		reply.Found = true
+		reply.PeerID = append(reply.PeerID, pi.PeerID)
+		reply.Addr = append(reply.Addr, pi.Addr)
+		reply.Names = append(reply.Names, pi.CertName)
+		reply.Info = append(reply.Info, info)
+		fmt.Printf("Found file %v for Peer %v on Peer %v\n", request.File, request.PeerID, pi.PeerID)
 	}
 
+	if reply.Found == false {
+		m.searchDir(request, reply)
+	}
 	if reply.Found == false{
 		fmt.Printf("Cannot find a Peer containing file %v for Peer %v\n", request.File, request.PeerID)
 	}
 	return nil
 }
 
+/*
+	Fills reply with every file under the directory named by
+	request.File, by name then PeerID. The caller must hold m.mu.
+*/
+func (m *Server) searchDir(request *protocol.RequestFileArgs, reply *protocol.FindPeerReply) {
+	prefix := strings.TrimSuffix(request.File, "/") + "/"
+	names := []string{}
+	for name := range m.byName {
+		if strings.HasPrefix(name, prefix) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		holders := make([]int, 0, len(m.byName[name]))
+		for peerID := range m.byName[name] {
+			holders = append(holders, peerID)
+		}
+		sort.Ints(holders)
+		for _, peerID := range holders {
+			pi := m.peers[peerID]
+			info := pi.Files[name]
+			if !pi.isConnected || !pi.visible(&info, request.CertName, request.Groups) {
+				continue
+			}
+			reply.Found = true
+			reply.Dir = true
+			reply.PeerID = append(reply.PeerID, pi.PeerID)
+			reply.Addr = append(reply.Addr, pi.Addr)
+			reply.Names = append(reply.Names, pi.CertName)
+			reply.Info = append(reply.Info, info)
+		}
+	}
+	if reply.Found {
+		fmt.Printf("Found directory %v (%v files) for Peer %v\n", request.File, len(names), request.PeerID)
+	}
+}
+
 /*
 	Starts the server.
 */
-func (m *Server) server() {
-	rpc.Register(m)
-	rpc.HandleHTTP()
+func (m *Server) server(listen string) {
+	serv := rpc.NewServer()
+	serv.Register(m)
+	mux := http.NewServeMux()
+	mux.Handle(rpc.DefaultRPCPath, protocol.NewHandler(serv, m.authenticate))
 
-	l, e := net.Listen("tcp", ":1337")
+	l, e := protocol.Listen(listen)
 	if e != nil {
 		log.Fatal("listen error:", e)
 	}
-	go http.Serve(l, nil)
+	m.listener = l
+	go http.Serve(l, mux)
 }
 
 /*
-	Creates a new Server
+	Creates a new Server, loading the registry and tokens
+	persisted in dataDir, with its admin endpoint on admin.
+	Peers must join with secret or a token, if there is one.
 */
-func MakeServer() *Server {
-	m := Server{}
-	// 10 Peers is arbitrary
-	m.peers = make([]PeerInfo, 100)
-	m.numPeers = 0
-	m.server()
-	return &m
+func MakeServer(listen string, dataDir string, admin string, secret string) *Server {
+	m := newServer()
+	if err := m.openStore(dataDir); err != nil {
+		log.Fatal("loading registry:", err)
+	}
+	if err := m.loadTokens(dataDir, secret); err != nil {
+		log.Fatal("loading tokens:", err)
+	}
+	m.server(listen)
+	if err := m.adminServer(admin); err != nil {
+		log.Fatal("admin listen error:", err)
+	}
+	go m.expirePeers()
+	go m.snapshotPeriodically()
+	return m
+}
+
+/*
+	Stops accepting connections, from Peers and on the admin
+	endpoint, and saves a snapshot of the registry so the next
+	start does not have to replay the log.
+*/
+func (m *Server) Shutdown() {
+	if m.listener != nil {
+		m.listener.Close()
+	}
+	if m.admin != nil {
+		m.admin.Close()
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.closeStore(); err != nil {
+		fmt.Printf("Error saving registry: %v\n", err)
+		return
+	}
+	fmt.Printf("Saved %v Peers, server shut down\n", len(m.peers))
 }
 
 /* 
 	List all the peer that has connected to server
 */
 func (m *Server) ListPeers() {
-	fmt.Printf("Num      PeerID      Address\n")
-	for i := 0; i < m.numPeers; i++ {
-		fmt.Printf("%v        %v           %v\n", i+1, m.peers[i].PeerID, "0.0.0.0" + m.peers[i].Port)
-	}
+	printPeers(m.peerStatuses())
+}
+
+/*
+	List all the files registered on the server
+*/
+func (m *Server) ListFiles() {
+	printFiles(m.registeredFiles())
 }
 
 /* 
@@ -148,22 +366,15 @@ func (m *Server) ListPeers() {
 */
 func (m *Server) PingPeer(peerID int) bool{
 	fmt.Printf("Pinging Peer %v\n", peerID)
-	check := 0
-	for i := 0; i < 3; i++ {
-		_ , err := net.Dial("tcp", m.peers[peerID].Port)
-		if err != nil {
-			check += 1
-		}
-	}
-	if check == 3 {
-		fmt.Printf("Peer not live!\n")
+	reply, err := m.ping(peerID)
+	if err != nil {
+		fmt.Printf("%v\n", err)
 		return false
-	} else{
-		fmt.Printf("%v/3 connection success\n", 3 - check)
-		fmt.Printf("Peer live!\n")
-		return true
 	}
+	printPing(reply)
+	return reply.Live
 }
+
 /* 
 	Discover all file in local repo of a peer
 */
@@ -174,31 +385,89 @@ func (m *Server) DiscoverFile(peerID int) {
 		return
 	}
 
-	request := RequestListFile{}
-	reply := ListFileReply{}
-	reply.Accepted = false
+	reply, err := m.discover(peerID)
+	if err != nil {
+		fmt.Printf("Error discovering files: %v\n", err)
+		return
+	}
+	printDiscover(reply)
+}
+
+/*
+	Evict a peer and its files from the registry
+*/
+func (m *Server) EvictPeer(peerID int) {
+	if _, err := m.evict(peerID); err != nil {
+		fmt.Printf("%v\n", err)
+	}
+}
 
-	call("Peer.ListFileReply", &request, &reply, m.peers[peerID].Port)
-	if reply.Accepted == true {
-		fmt.Printf("Num      Files\n")
-		for i := 0; i < reply.NumFiles; i++ {
-			fmt.Printf("%v        %v\n", i+1, reply.File[i])
+func printPeers(peers []protocol.PeerStatus) {
+	fmt.Printf("Num      PeerID      Address                  Status      Files    Last seen\n")
+	for i, pi := range peers {
+		lastSeen := "never"
+		if !pi.LastSeen.IsZero() {
+			lastSeen = fmt.Sprintf("%v (%v ago)", pi.LastSeen.Format("15:04:05"), time.Since(pi.LastSeen).Round(time.Second))
 		}
+		fmt.Printf("%-8v %-11v %-24v %-11v %-8v %v\n", i+1, pi.PeerID, pi.Addr, pi.Status, pi.NumFiles, lastSeen)
 	}
-	return 
 }
 
-func call(rpcname string, args interface{}, reply interface{}, port string) bool {
-	c, err := rpc.DialHTTP("tcp", port)
-	if err != nil {
-		log.Fatal("dialing:", err)
+func printFiles(files []protocol.RegisteredFile) {
+	fmt.Printf("Num      PeerID      Status      Size         Hash           Files\n")
+	for i, f := range files {
+		fmt.Printf("%-8v %-11v %-11v %-12v %-14.12v %v\n", i+1, f.PeerID, f.Status, f.Info.Size, f.Info.Hash, f.Info.Name)
+	}
+}
+
+func printTokens(tokens []protocol.TokenInfo) {
+	fmt.Printf("Num      ID         User                 Status      Issued\n")
+	for i, t := range tokens {
+		status := "active"
+		if t.Revoked {
+			status = "revoked"
+		}
+		fmt.Printf("%-8v %-10v %-20v %-11v %v\n", i+1, t.ID, t.User, status, t.Created.Format("2006-01-02 15:04"))
 	}
-	defer c.Close()
+}
 
-	err = c.Call(rpcname, args, reply)
-	if err == nil {
-		return true
+func printPing(reply protocol.AdminPingReply) {
+	if !reply.Live {
+		fmt.Printf("Peer not live!\n")
+		return
 	}
-	fmt.Println(err)
-	return false
+	fmt.Printf("%v/%v connection success\n", reply.Successes, reply.Attempts)
+	fmt.Printf("Peer live!\n")
+}
+
+func printDiscover(reply protocol.AdminDiscoverReply) {
+	fmt.Printf("Num      Size         Type                     Modified             Files\n")
+	for i, info := range reply.Files {
+		fmt.Printf("%-8v %-12v %-24v %-20v %v\n", i+1, info.Size, info.MimeType, info.ModTime.Format("2006-01-02 15:04:05"), info.Name)
+		if info.Description != "" || len(info.Tags) > 0 || len(info.Access) > 0 || info.Encrypted {
+			fmt.Printf("         %v %v %v\n", info.Description, info.FormatTags(), info.FormatAccess())
+		}
+	}
+}
+
+/*
+	Returns the address of a Peer, and false if there is no such Peer.
+*/
+func (m *Server) peerAddr(peerID int) (string, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	pi := m.findPeer(peerID)
+	if pi == nil {
+		return "", false
+	}
+	return pi.Addr, true
+}
+
+/*
+	Method used to make Remote Procedure Calls (RPCs) to Peers.
+	Transient failures are retried, see protocol.Call().
+*/
+func call(rpcname string, args interface{}, reply interface{}, addr string) error {
+	return protocol.Call(context.Background(), addr, rpcname, args, reply)
 }
\ No newline at end of file
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/junvalentine/FileSharing/protocol"
+)
+
+/*
+	Builds a Server holding numPeers connected Peers sharing
+	filesPerPeer files each. Every file name is shared by 10 Peers.
+*/
+func populate(numPeers int, filesPerPeer int) *Server {
+	m := newServer()
+	for i := 0; i < numPeers; i++ {
+		pi := m.addPeer(i)
+		m.setIdentity(pi, fmt.Sprintf("peer-%v", i))
+		pi.Addr = fmt.Sprintf("127.0.0.1:%v", 20000+i)
+		pi.isConnected = true
+		for j := 0; j < filesPerPeer; j++ {
+			name := fmt.Sprintf("file-%v-%v.bin", i/10, j)
+			m.addFile(pi, name, protocol.FileInfo{Name: name, Size: int64(j), Hash: name})
+		}
+	}
+	return m
+}
+
+/*
+	Silences the Server's output for the rest of the benchmark.
+*/
+func quiet(b *testing.B) {
+	devNull, err := os.Open(os.DevNull)
+	if err != nil {
+		b.Fatal(err)
+	}
+	stdout := os.Stdout
+	os.Stdout = devNull
+	b.Cleanup(func() {
+		os.Stdout = stdout
+		devNull.Close()
+	})
+}
+
+func BenchmarkSearchFile(b *testing.B) {
+	for _, size := range []struct{ peers, files int }{{100, 100}, {1000, 100}, {10000, 100}} {
+		b.Run(fmt.Sprintf("%vpeers-%vfiles", size.peers, size.files), func(b *testing.B) {
+			m := populate(size.peers, size.files)
+			quiet(b)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				request := protocol.RequestFileArgs{File: fmt.Sprintf("file-%v-%v.bin", i%(size.peers/10), i%size.files)}
+				reply := protocol.FindPeerReply{}
+				m.SearchFile(&request, &reply)
+				if len(reply.PeerID) != 10 {
+					b.Fatalf("found %v holders of %v, want 10", len(reply.PeerID), request.File)
+				}
+			}
+		})
+	}
+}
+
+/*
+	A repository served on one port while "peer publish" and
+	"peer fetch" run on it with another. The Server must keep
+	listing the Peer at the address it serves on.
+*/
+func TestOneShotConnect(t *testing.T) {
+	m := newServer()
+	serve := protocol.ConnectRequest{Version: protocol.Version, Identity: "repo", Port: ":8080", RemoteAddr: "10.0.0.5:40000"}
+	oneShot := protocol.ConnectRequest{Version: protocol.Version, Identity: "repo", Port: ":19002", RemoteAddr: "10.0.0.5:40001", OneShot: true}
+
+	reply := protocol.ConnectReply{}
+	if err := m.ConnectPeer(&serve, &reply); err != nil {
+		t.Fatal(err)
+	}
+	peerID := reply.PeerID
+	reply = protocol.ConnectReply{}
+	if err := m.ConnectPeer(&oneShot, &reply); err != nil || !reply.Accepted || reply.PeerID != peerID {
+		t.Fatalf("one-shot connect: %v, %+v", err, reply)
+	}
+	register(t, m, peerID, "notes.txt")
+
+	pi := m.peers[peerID]
+	if pi.Addr != "10.0.0.5:8080" || !pi.isConnected {
+		t.Errorf("after a one-shot connect the Peer is at %v, online %v", pi.Addr, pi.isConnected)
+	}
+	request := protocol.RequestFileArgs{File: "notes.txt"}
+	found := protocol.FindPeerReply{}
+	if err := m.SearchFile(&request, &found); err != nil {
+		t.Fatal(err)
+	}
+	if len(found.Addr) != 1 || found.Addr[0] != "10.0.0.5:8080" {
+		t.Errorf("notes.txt is listed at %v, want 10.0.0.5:8080", found.Addr)
+	}
+
+	// A repository that is not served yet stays offline.
+	oneShot.Identity = "other"
+	reply = protocol.ConnectReply{}
+	if err := m.ConnectPeer(&oneShot, &reply); err != nil || !reply.Accepted {
+		t.Fatalf("one-shot connect: %v, %+v", err, reply)
+	}
+	register(t, m, reply.PeerID, "other.txt")
+	if pi := m.peers[reply.PeerID]; pi.Addr != "" || pi.isConnected {
+		t.Errorf("a Peer only run for commands is at %q, online %v", pi.Addr, pi.isConnected)
+	}
+	found = protocol.FindPeerReply{}
+	request.File = "other.txt"
+	if err := m.SearchFile(&request, &found); err != nil {
+		t.Fatal(err)
+	}
+	if len(found.PeerID) != 0 {
+		t.Errorf("other.txt is listed at %v before it is served", found.Addr)
+	}
+}
@@ -0,0 +1,432 @@
+/*
+	This file contains the Server's persistent registry. Every change
+	to the registry (a Peer connecting, registering or unregistering a
+	file, disconnecting, or being evicted) is appended to "registry.log" and synced before the RPC
+	returns. Heartbeats are logged at most once per lease, so the
+	time a Peer was last seen survives a crash to within a lease. A snapshot of the whole registry, and of the next PeerID
+	to hand out, is written to "registry.snapshot" periodically, after
+	which the log starts over.
+
+	On start the snapshot is loaded and the log replayed on top of it.
+	Snapshots are written to a temporary file and renamed (and the
+	directory synced so the rename is durable), and a torn
+	last line in the log (a crash mid-write) is dropped, so a crash at
+	any point leaves a readable state. Replaying a record twice has no
+	effect, so a crash between a snapshot and the log being reset is
+	harmless too.
+*/
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/junvalentine/FileSharing/protocol"
+)
+
+/*
+	How often the registry is snapshotted when it changed.
+*/
+const snapshotInterval = time.Minute
+
+const (
+	opConnect    = "connect"
+	opRegister   = "register"
+	opUnregister = "unregister"
+	opDisconnect = "disconnect"
+	opEvict      = "evict"
+	opHeartbeat  = "heartbeat"
+)
+
+/*
+	One change to the registry, as stored in the log.
+*/
+type logRecord struct {
+	Op       string
+	PeerID   int
+	Identity string             `json:",omitempty"`
+	Addr     string             `json:",omitempty"`
+	CertName string             `json:",omitempty"`
+	User     string             `json:",omitempty"`
+	OneShot  bool               `json:",omitempty"`
+	FileName string             `json:",omitempty"`
+	Info     *protocol.FileInfo `json:",omitempty"`
+	LastSeen *time.Time         `json:",omitempty"`
+}
+
+/*
+	One Peer, as stored in the snapshot.
+*/
+type peerRecord struct {
+	PeerID   int
+	Identity string
+	Addr     string
+	CertName string
+	User     string
+	LastSeen time.Time
+	Offline  bool `json:",omitempty"`
+	Files    []string
+	Infos    []protocol.FileInfo
+}
+
+/*
+	The contents of the snapshot. NextPeerID is kept so that the
+	PeerIDs of evicted Peers are never handed out again.
+*/
+type snapshotData struct {
+	NextPeerID int
+	Peers      []peerRecord
+}
+
+/*
+	The files the registry is persisted in.
+*/
+type registryStore struct {
+	dir     string
+	log     *os.File
+	pending int
+}
+
+func (s *registryStore) logPath() string {
+	return filepath.Join(s.dir, "registry.log")
+}
+
+func (s *registryStore) snapshotPath() string {
+	return filepath.Join(s.dir, "registry.snapshot")
+}
+
+/*
+	Opens the registry stored in dir and loads it into the Server.
+	Loaded Peers are marked as restored (unverified) and offline
+	until they send a heartbeat or connect again, except the ones
+	that disconnected, which are just offline.
+*/
+func (m *Server) openStore(dir string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("creating data directory: %v", err)
+	}
+	s := &registryStore{dir: dir}
+
+	data, err := os.ReadFile(s.snapshotPath())
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("reading snapshot: %v", err)
+	}
+	if err == nil {
+		snap := snapshotData{}
+		// Older snapshots only hold the list of Peers.
+		if len(data) > 0 && data[0] == '[' {
+			err = json.Unmarshal(data, &snap.Peers)
+		} else {
+			err = json.Unmarshal(data, &snap)
+		}
+		if err != nil {
+			return fmt.Errorf("reading snapshot: %v", err)
+		}
+		for _, r := range snap.Peers {
+			pi := m.addPeer(r.PeerID)
+			m.setIdentity(pi, r.Identity)
+			pi.Addr = r.Addr
+			pi.CertName = r.CertName
+			pi.User = r.User
+			pi.lastSeen = r.LastSeen
+			pi.seenLogged = r.LastSeen
+			pi.disconnected = r.Offline
+			for j := range r.Files {
+				m.addFile(pi, r.Files[j], r.Infos[j])
+			}
+		}
+		if snap.NextPeerID > m.nextPeerID {
+			m.nextPeerID = snap.NextPeerID
+		}
+	}
+
+	valid, replayed, err := m.replayLog(s.logPath())
+	if err != nil {
+		return err
+	}
+	s.log, err = os.OpenFile(s.logPath(), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return fmt.Errorf("opening log: %v", err)
+	}
+	if err := syncDir(dir); err != nil {
+		return fmt.Errorf("opening log: %v", err)
+	}
+	// Drop whatever follows the last complete record.
+	if err := s.log.Truncate(valid); err != nil {
+		return fmt.Errorf("repairing log: %v", err)
+	}
+	if _, err := s.log.Seek(valid, 0); err != nil {
+		return fmt.Errorf("repairing log: %v", err)
+	}
+	s.pending = replayed
+
+	for _, pi := range m.peers {
+		pi.isConnected = false
+		pi.restored = !pi.disconnected
+	}
+	m.store = s
+	fmt.Printf("Loaded %v Peers from %v\n", len(m.peers), dir)
+	return nil
+}
+
+/*
+	Applies the records of the log to the Server. Returns the
+	length of the valid part of the log and the number of records.
+*/
+func (m *Server) replayLog(path string) (int64, int, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return 0, 0, nil
+	} else if err != nil {
+		return 0, 0, fmt.Errorf("reading log: %v", err)
+	}
+	defer f.Close()
+
+	var valid int64
+	n := 0
+	reader := bufio.NewReader(f)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err != nil {
+			// A missing newline means the last write was torn.
+			break
+		}
+		r := logRecord{}
+		if json.Unmarshal(line, &r) != nil {
+			break
+		}
+		m.applyRecord(&r)
+		valid += int64(len(line))
+		n++
+	}
+	return valid, n, nil
+}
+
+/*
+	Applies one logged change to the registry.
+*/
+func (m *Server) applyRecord(r *logRecord) {
+	pi := m.findPeer(r.PeerID)
+	switch r.Op {
+	case opConnect:
+		if pi == nil {
+			pi = m.addPeer(r.PeerID)
+		}
+		m.setIdentity(pi, r.Identity)
+		pi.Addr = r.Addr
+		pi.CertName = r.CertName
+		pi.User = r.User
+		if !r.OneShot {
+			pi.disconnected = false
+		}
+		m.restoreSeen(pi, r)
+	case opHeartbeat:
+		if pi == nil {
+			return
+		}
+		pi.disconnected = false
+		m.restoreSeen(pi, r)
+	case opRegister:
+		if pi == nil || r.Info == nil {
+			return
+		}
+		m.addFile(pi, r.FileName, *r.Info)
+	case opUnregister:
+		if pi == nil {
+			return
+		}
+		m.removeFile(pi, r.FileName)
+	case opDisconnect:
+		if pi == nil {
+			return
+		}
+		pi.disconnected = true
+		m.restoreSeen(pi, r)
+	case opEvict:
+		if pi == nil {
+			return
+		}
+		m.removePeer(pi)
+	}
+}
+
+/*
+	Sets the time a Peer was last seen from a logged change.
+	Records written before they carried the time leave it as is.
+*/
+func (m *Server) restoreSeen(pi *PeerInfo, r *logRecord) {
+	if r.LastSeen != nil {
+		pi.lastSeen = *r.LastSeen
+		pi.seenLogged = *r.LastSeen
+	}
+}
+
+/*
+	Marks a Peer as seen now. The time is added to the record
+	r, if it is not nil, otherwise it is logged on its own when
+	the last logged time is a lease old. The caller must hold m.mu.
+*/
+func (m *Server) markSeen(pi *PeerInfo, r *logRecord) {
+	now := time.Now()
+	pi.lastSeen = now
+	if r == nil {
+		if now.Sub(pi.seenLogged) < leaseDuration {
+			return
+		}
+		r = &logRecord{Op: opHeartbeat, PeerID: pi.PeerID}
+	}
+	r.LastSeen = &now
+	pi.seenLogged = now
+	m.persist(*r)
+}
+
+/*
+	Appends a change to the log and syncs it to disk.
+	The caller must hold m.mu.
+*/
+func (m *Server) persist(r logRecord) {
+	if m.store == nil {
+		return
+	}
+	data, err := json.Marshal(r)
+	if err != nil {
+		fmt.Printf("Error persisting registry: %v\n", err)
+		return
+	}
+	data = append(data, '\n')
+	if _, err := m.store.log.Write(data); err != nil {
+		fmt.Printf("Error persisting registry: %v\n", err)
+		return
+	}
+	if err := m.store.log.Sync(); err != nil {
+		fmt.Printf("Error persisting registry: %v\n", err)
+		return
+	}
+	m.store.pending++
+}
+
+/*
+	Writes a snapshot of the registry and resets the log.
+	The caller must hold m.mu.
+*/
+func (m *Server) snapshot() error {
+	if m.store == nil {
+		return nil
+	}
+	s := m.store
+
+	snap := snapshotData{NextPeerID: m.nextPeerID, Peers: make([]peerRecord, 0, len(m.peers))}
+	for _, peerID := range m.peerIDs() {
+		pi := m.peers[peerID]
+		r := peerRecord{
+			PeerID:   pi.PeerID,
+			Identity: pi.Identity,
+			Addr:     pi.Addr,
+			CertName: pi.CertName,
+			User:     pi.User,
+			LastSeen: pi.lastSeen,
+			Offline:  pi.disconnected,
+		}
+		for _, name := range pi.fileNames() {
+			r.Files = append(r.Files, name)
+			r.Infos = append(r.Infos, pi.Files[name])
+		}
+		snap.Peers = append(snap.Peers, r)
+	}
+	data, err := json.Marshal(snap)
+	if err != nil {
+		return err
+	}
+
+	if err := writeAtomic(s.snapshotPath(), data, 0644); err != nil {
+		return err
+	}
+
+	if err := s.log.Truncate(0); err != nil {
+		return err
+	}
+	if _, err := s.log.Seek(0, 0); err != nil {
+		return err
+	}
+	s.pending = 0
+	return nil
+}
+
+/*
+	Writes data to a temporary file, syncs it and renames it
+	to path, so path always holds either the old or new data.
+	The directory is synced too, so the rename survives a crash.
+*/
+func writeAtomic(path string, data []byte, perm os.FileMode) error {
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(path))
+}
+
+/*
+	Syncs a directory, making the files created, renamed or
+	removed in it durable.
+*/
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+/*
+	Writes a final snapshot and closes the log. Changes made
+	afterwards are no longer persisted. The caller must hold m.mu.
+*/
+func (m *Server) closeStore() error {
+	if m.store == nil {
+		return nil
+	}
+	err := m.snapshot()
+	if cerr := m.store.log.Close(); err == nil {
+		err = cerr
+	}
+	m.store = nil
+	return err
+}
+
+/*
+	Snapshots the registry every snapshotInterval if it changed, forever.
+*/
+func (m *Server) snapshotPeriodically() {
+	for {
+		time.Sleep(snapshotInterval)
+
+		m.mu.Lock()
+		if m.store != nil && m.store.pending > 0 {
+			if err := m.snapshot(); err != nil {
+				fmt.Printf("Error writing snapshot: %v\n", err)
+			}
+		}
+		m.mu.Unlock()
+	}
+}
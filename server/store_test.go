@@ -0,0 +1,253 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/junvalentine/FileSharing/protocol"
+)
+
+func openTestStore(t *testing.T, dir string) *Server {
+	t.Helper()
+	m := newServer()
+	if err := m.openStore(dir); err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+/*
+	Closes the log without the final snapshot closeStore() writes,
+	as if the Server crashed, and loads the registry again.
+*/
+func crash(t *testing.T, m *Server, dir string) *Server {
+	t.Helper()
+	m.store.log.Close()
+	return openTestStore(t, dir)
+}
+
+func connect(t *testing.T, m *Server, identity string) int {
+	t.Helper()
+	request := protocol.ConnectRequest{Version: protocol.Version, Identity: identity, Port: "127.0.0.1:9000"}
+	reply := protocol.ConnectReply{}
+	if err := m.ConnectPeer(&request, &reply); err != nil || !reply.Accepted {
+		t.Fatalf("connecting %v: %v", identity, err)
+	}
+	return reply.PeerID
+}
+
+func register(t *testing.T, m *Server, peerID int, name string) {
+	t.Helper()
+	request := protocol.PeerSendFile{PeerID: peerID, FileName: name, Info: protocol.FileInfo{Name: name, Hash: name}}
+	reply := protocol.ServerReceiveFile{}
+	if err := m.Register(&request, &reply); err != nil || !reply.Accepted {
+		t.Fatalf("registering %v: %v", name, err)
+	}
+}
+
+func unregister(t *testing.T, m *Server, peerID int, name string) {
+	t.Helper()
+	request := protocol.PeerSendFile{PeerID: peerID, FileName: name}
+	reply := protocol.ServerReceiveFile{}
+	if err := m.Unregister(&request, &reply); err != nil || !reply.Accepted {
+		t.Fatalf("unregistering %v: %v", name, err)
+	}
+}
+
+func disconnect(t *testing.T, m *Server, peerID int) {
+	t.Helper()
+	request := protocol.DisconnectArgs{PeerID: peerID}
+	reply := protocol.DisconnectReply{}
+	if err := m.Disconnect(&request, &reply); err != nil || !reply.Accepted {
+		t.Fatalf("disconnecting %v: %v", peerID, err)
+	}
+}
+
+func snapshot(t *testing.T, m *Server) {
+	t.Helper()
+	if err := m.snapshot(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+/*
+	Removes the last n bytes of the log, as a crash in the
+	middle of a write would.
+*/
+func tearLog(t *testing.T, dir string, n int64) {
+	t.Helper()
+	path := filepath.Join(dir, "registry.log")
+	stat, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Truncate(path, stat.Size()-n); err != nil {
+		t.Fatal(err)
+	}
+}
+
+/*
+	Returns the files and status of every Peer, as
+	"<PeerID>: <status> <files>".
+*/
+func registry(m *Server) []string {
+	peers := []string{}
+	for _, peerID := range m.peerIDs() {
+		pi := m.peers[peerID]
+		peers = append(peers, fmt.Sprintf("%v: %v %v", peerID, pi.status(), pi.fileNames()))
+	}
+	return peers
+}
+
+func TestStoreReload(t *testing.T) {
+	cases := []struct {
+		name  string
+		run   func(t *testing.T, m *Server, dir string)
+		peers []string
+		next  int
+	}{
+		{"log", func(t *testing.T, m *Server, dir string) {
+			a, b := connect(t, m, "a"), connect(t, m, "b")
+			register(t, m, a, "x.txt")
+			register(t, m, a, "y.txt")
+			register(t, m, b, "z.txt")
+			unregister(t, m, a, "y.txt")
+		}, []string{"0: unverified [x.txt]", "1: unverified [z.txt]"}, 2},
+		{"torn last record", func(t *testing.T, m *Server, dir string) {
+			a := connect(t, m, "a")
+			register(t, m, a, "x.txt")
+			register(t, m, a, "y.txt")
+			tearLog(t, dir, 10)
+		}, []string{"0: unverified [x.txt]"}, 1},
+		{"torn newline", func(t *testing.T, m *Server, dir string) {
+			a := connect(t, m, "a")
+			register(t, m, a, "x.txt")
+			tearLog(t, dir, 1)
+		}, []string{"0: unverified []"}, 1},
+		{"snapshot then log", func(t *testing.T, m *Server, dir string) {
+			a := connect(t, m, "a")
+			register(t, m, a, "x.txt")
+			snapshot(t, m)
+			register(t, m, a, "y.txt")
+			connect(t, m, "b")
+		}, []string{"0: unverified [x.txt y.txt]", "1: unverified []"}, 2},
+		{"snapshot then torn log", func(t *testing.T, m *Server, dir string) {
+			a := connect(t, m, "a")
+			snapshot(t, m)
+			register(t, m, a, "x.txt")
+			tearLog(t, dir, 5)
+		}, []string{"0: unverified []"}, 1},
+		{"disconnect", func(t *testing.T, m *Server, dir string) {
+			a, _ := connect(t, m, "a"), connect(t, m, "b")
+			disconnect(t, m, a)
+		}, []string{"0: offline []", "1: unverified []"}, 2},
+		{"disconnect then snapshot", func(t *testing.T, m *Server, dir string) {
+			a, _ := connect(t, m, "a"), connect(t, m, "b")
+			disconnect(t, m, a)
+			snapshot(t, m)
+		}, []string{"0: offline []", "1: unverified []"}, 2},
+		{"reconnect after disconnect", func(t *testing.T, m *Server, dir string) {
+			a := connect(t, m, "a")
+			disconnect(t, m, a)
+			connect(t, m, "a")
+		}, []string{"0: unverified []"}, 1},
+		{"evict", func(t *testing.T, m *Server, dir string) {
+			a, b := connect(t, m, "a"), connect(t, m, "b")
+			register(t, m, a, "x.txt")
+			register(t, m, b, "x.txt")
+			if _, err := m.evict(b); err != nil {
+				t.Fatal(err)
+			}
+		}, []string{"0: unverified [x.txt]"}, 2},
+		{"evict then snapshot", func(t *testing.T, m *Server, dir string) {
+			connect(t, m, "a")
+			b := connect(t, m, "b")
+			if _, err := m.evict(b); err != nil {
+				t.Fatal(err)
+			}
+			snapshot(t, m)
+		}, []string{"0: unverified []"}, 2},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			dir := t.TempDir()
+			m := openTestStore(t, dir)
+			c.run(t, m, dir)
+
+			m = crash(t, m, dir)
+			if got := registry(m); !reflect.DeepEqual(got, c.peers) {
+				t.Errorf("after reload got %q, want %q", got, c.peers)
+			}
+			if m.nextPeerID != c.next {
+				t.Errorf("next PeerID %v, want %v", m.nextPeerID, c.next)
+			}
+
+			// The log accepts new records after a repair, and
+			// new Peers never get the PeerID of an evicted one.
+			late := connect(t, m, "late")
+			if late != c.next {
+				t.Errorf("new Peer got PeerID %v, want %v", late, c.next)
+			}
+			m = crash(t, m, dir)
+			want := append(append([]string{}, c.peers...), fmt.Sprintf("%v: unverified []", late))
+			if got := registry(m); !reflect.DeepEqual(got, want) {
+				t.Errorf("after second reload got %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+func TestLegacySnapshot(t *testing.T) {
+	dir := t.TempDir()
+	legacy := `[{"PeerID":3,"Identity":"a","Addr":"127.0.0.1:9000","Files":["x.txt"],"Infos":[{"Name":"x.txt","Hash":"x"}]}]`
+	if err := os.WriteFile(filepath.Join(dir, "registry.snapshot"), []byte(legacy), 0644); err != nil {
+		t.Fatal(err)
+	}
+	m := openTestStore(t, dir)
+	if got, want := registry(m), []string{"3: unverified [x.txt]"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if m.nextPeerID != 4 {
+		t.Errorf("next PeerID %v, want 4", m.nextPeerID)
+	}
+}
+
+func heartbeat(t *testing.T, m *Server, peerID int) {
+	t.Helper()
+	if !sendHeartbeat(m, peerID) {
+		t.Fatalf("heartbeat of %v refused", peerID)
+	}
+}
+
+func TestLastSeenReload(t *testing.T) {
+	dir := t.TempDir()
+	m := openTestStore(t, dir)
+	a, b, c := connect(t, m, "a"), connect(t, m, "b"), connect(t, m, "c")
+
+	// A heartbeat within a lease of the last logged time is not
+	// logged, a later one is.
+	heartbeat(t, m, a)
+	m.peers[b].seenLogged = m.peers[b].seenLogged.Add(-leaseDuration)
+	heartbeat(t, m, b)
+	disconnect(t, m, c)
+	want := map[int]time.Time{a: m.peers[a].seenLogged, b: m.peers[b].lastSeen, c: m.peers[c].lastSeen}
+
+	m = crash(t, m, dir)
+	for peerID, seen := range want {
+		if got := m.peers[peerID].lastSeen; !got.Equal(seen) {
+			t.Errorf("Peer %v last seen %v after reload, want %v", peerID, got, seen)
+		}
+	}
+	snapshot(t, m)
+	m = crash(t, m, dir)
+	for peerID, seen := range want {
+		if got := m.peers[peerID].lastSeen; !got.Equal(seen) {
+			t.Errorf("Peer %v last seen %v after a snapshot, want %v", peerID, got, seen)
+		}
+	}
+}
@@ -1,26 +1,199 @@
+/*
+	This file contains the Server's registry data structures. Peers
+	are kept in a map by PeerID, and the registry is indexed by Peer
+	identity, by file name and by content hash so that lookups do not
+	depend on the number of Peers or files registered.
+*/
+
 package main
 
 import (
-	"sync"
+	"errors"
+	"sort"
+	"time"
+
+	"github.com/junvalentine/FileSharing/protocol"
 )
 
-type Peer struct {
-	PeerID    int
-	files     []string
-	fileloc   []string
-	peers     []int
-	numFiles  int
-	numPeers  int
-	directory string
-	Port      string
-	mu        sync.Mutex
+/*
+	A lightweight data type for the Server to hold relevant
+	information about the Peers connected to it, including
+	their address and the files they posses (by name).
+*/
+type PeerInfo struct {
+	PeerID       int
+	Identity     string
+	Addr         string
+	CertName     string
+	User         string
+	Files        map[string]protocol.FileInfo
+	tokenID      string
+	isConnected  bool
+	restored     bool
+	disconnected bool
+	lastSeen     time.Time
+	seenLogged   time.Time
 }
 
-type PeerInfo struct {
-	PeerID      int
-	Port        string
-	Files       [100]string
-	// Fileloc		[100]string
-	numFiles    int
-	isConnected bool
-}
\ No newline at end of file
+/*
+	Identifies one registered file: a name on a Peer.
+*/
+type fileKey struct {
+	PeerID int
+	Name   string
+}
+
+/*
+	Returns the names of the Peer's files, sorted.
+*/
+func (pi *PeerInfo) fileNames() []string {
+	names := make([]string, 0, len(pi.Files))
+	for name := range pi.Files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+/*
+	Returned to RPCs about a Peer made with another
+	Peer's certificate or token.
+*/
+var errNotAuthorized = errors.New("not authorized for this Peer")
+
+/*
+	Returns true if a request made with the certificate named
+	certName and a token of user may act as the Peer. Without
+	TLS and tokens they are all "".
+*/
+func (pi *PeerInfo) authorized(certName string, user string) bool {
+	return pi.CertName == certName && pi.User == user
+}
+
+/*
+	Returns true if a Peer connecting with the certificate named
+	certName and a token of user may take the Peer's Identity:
+	what the Identity is already bound to must match.
+*/
+func (pi *PeerInfo) claimable(certName string, user string) bool {
+	return (pi.CertName == "" || pi.CertName == certName) && (pi.User == "" || pi.User == user)
+}
+
+/*
+	Returns true if the holder of the certificate named certName,
+	in groups, may see the Peer's copy of a file: the file's access
+	list allows it, or it is the Peer itself.
+*/
+func (pi *PeerInfo) visible(info *protocol.FileInfo, certName string, groups []string) bool {
+	return info.Allows(certName, groups) || (certName != "" && pi.CertName == certName)
+}
+
+/*
+	Returns the Peer with the given PeerID, or nil.
+	The caller must hold m.mu.
+*/
+func (m *Server) findPeer(peerID int) *PeerInfo {
+	return m.peers[peerID]
+}
+
+/*
+	Returns the Peer with the given PeerID, creating it if needed.
+	The caller must hold m.mu.
+*/
+func (m *Server) addPeer(peerID int) *PeerInfo {
+	if pi, ok := m.peers[peerID]; ok {
+		return pi
+	}
+	pi := &PeerInfo{PeerID: peerID, Files: map[string]protocol.FileInfo{}}
+	m.peers[peerID] = pi
+	if peerID >= m.nextPeerID {
+		m.nextPeerID = peerID + 1
+	}
+	return pi
+}
+
+/*
+	Sets the identity of a Peer and indexes it.
+	The caller must hold m.mu.
+*/
+func (m *Server) setIdentity(pi *PeerInfo, identity string) {
+	if pi.Identity != "" {
+		delete(m.byIdentity, pi.Identity)
+	}
+	pi.Identity = identity
+	if identity != "" {
+		m.byIdentity[identity] = pi.PeerID
+	}
+}
+
+/*
+	Removes a Peer, its identity and its files from the registry.
+	The caller must hold m.mu.
+*/
+func (m *Server) removePeer(pi *PeerInfo) {
+	for _, name := range pi.fileNames() {
+		m.removeFile(pi, name)
+	}
+	if pi.Identity != "" && m.byIdentity[pi.Identity] == pi.PeerID {
+		delete(m.byIdentity, pi.Identity)
+	}
+	delete(m.peers, pi.PeerID)
+}
+
+/*
+	Returns the PeerIDs of every Peer, sorted.
+	The caller must hold m.mu.
+*/
+func (m *Server) peerIDs() []int {
+	ids := make([]int, 0, len(m.peers))
+	for id := range m.peers {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	return ids
+}
+
+/*
+	Adds a file to a Peer, or replaces its metadata if the Peer
+	already has a file with that name. Returns true if it replaced
+	an existing file. The caller must hold m.mu.
+*/
+func (m *Server) addFile(pi *PeerInfo, name string, info protocol.FileInfo) bool {
+	_, updated := pi.Files[name]
+	if updated {
+		m.removeFile(pi, name)
+	}
+	pi.Files[name] = info
+
+	if m.byName[name] == nil {
+		m.byName[name] = map[int]bool{}
+	}
+	m.byName[name][pi.PeerID] = true
+	if m.byHash[info.Hash] == nil {
+		m.byHash[info.Hash] = map[fileKey]bool{}
+	}
+	m.byHash[info.Hash][fileKey{pi.PeerID, name}] = true
+	return updated
+}
+
+/*
+	Removes a file from a Peer. Returns false if the Peer
+	had no such file. The caller must hold m.mu.
+*/
+func (m *Server) removeFile(pi *PeerInfo, name string) bool {
+	info, ok := pi.Files[name]
+	if !ok {
+		return false
+	}
+	delete(pi.Files, name)
+
+	delete(m.byName[name], pi.PeerID)
+	if len(m.byName[name]) == 0 {
+		delete(m.byName, name)
+	}
+	delete(m.byHash[info.Hash], fileKey{pi.PeerID, name})
+	if len(m.byHash[info.Hash]) == 0 {
+		delete(m.byHash, info.Hash)
+	}
+	return true
+}
@@ -0,0 +1,245 @@
+/*
+	This file contains the join tokens Peers authenticate with. Once a
+	shared secret is configured or the first token is issued, every
+	connection to the Server must carry a valid token (see
+	protocol/transport.go), so unknown processes can neither connect
+	nor register files. Each token is issued to a user and can be
+	revoked on its own; a Peer's Identity is bound to the user it
+	first joined as, the way it is to its certificate with TLS.
+	Revoking a token only drops the Peers that joined with it.
+
+	Tokens look like "<ID>.<secret>". Only a hash of each token is
+	kept, in "tokens.json" in the data directory.
+*/
+
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/junvalentine/FileSharing/protocol"
+)
+
+const tokensFile = "tokens.json"
+
+/*
+	User the shared secret authenticates as. Peers joining
+	with it are not bound to a user.
+*/
+const sharedUser = ""
+
+/*
+	One issued token, as stored in tokens.json.
+*/
+type tokenRecord struct {
+	ID      string
+	User    string
+	Hash    string
+	Created time.Time
+	Revoked bool
+}
+
+/*
+	The tokens the Server accepts, and the shared secret.
+*/
+type tokenStore struct {
+	path   string
+	secret string
+	tokens map[string]*tokenRecord
+}
+
+/*
+	Loads the tokens issued by the Server from dir.
+*/
+func (m *Server) loadTokens(dir string, secret string) error {
+	s := &tokenStore{path: filepath.Join(dir, tokensFile), secret: secret, tokens: map[string]*tokenRecord{}}
+	data, err := os.ReadFile(s.path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err == nil {
+		records := []*tokenRecord{}
+		if err := json.Unmarshal(data, &records); err != nil {
+			return fmt.Errorf("parsing %v: %v", s.path, err)
+		}
+		for _, r := range records {
+			s.tokens[r.ID] = r
+		}
+	}
+	m.tokens = s
+	if m.authRequired() {
+		fmt.Printf("Peers must join with a token (%v issued)\n", len(s.tokens))
+	}
+	return nil
+}
+
+/*
+	Writes every token to tokens.json.
+*/
+func (s *tokenStore) save() error {
+	records := make([]*tokenRecord, 0, len(s.tokens))
+	for _, r := range s.tokens {
+		records = append(records, r)
+	}
+	sort.Slice(records, func(i, j int) bool { return records[i].Created.Before(records[j].Created) })
+	data, err := json.MarshalIndent(records, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeAtomic(s.path, data, 0600)
+}
+
+/*
+	Returns true once Peers must present a token: when a shared
+	secret is set or a token was ever issued, even if revoked since.
+	The caller must hold m.mu.
+*/
+func (m *Server) authRequired() bool {
+	return m.tokens != nil && (m.tokens.secret != "" || len(m.tokens.tokens) > 0)
+}
+
+/*
+	Checks the token a connection was made with and returns
+	the user it was issued to and its ID ("" for the shared
+	secret). Used as the protocol.Authenticator of the Peers'
+	listener.
+*/
+func (m *Server) authenticate(token string) (string, string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if !m.authRequired() {
+		return sharedUser, "", nil
+	}
+	if token == "" {
+		return "", "", errors.New("a join token is required")
+	}
+	s := m.tokens
+	if s.secret != "" && subtle.ConstantTimeCompare([]byte(token), []byte(s.secret)) == 1 {
+		return sharedUser, "", nil
+	}
+	id, _, _ := strings.Cut(token, ".")
+	r, ok := s.tokens[id]
+	if !ok || subtle.ConstantTimeCompare([]byte(hashToken(token)), []byte(r.Hash)) != 1 {
+		return "", "", errors.New("invalid token")
+	}
+	if r.Revoked {
+		return "", "", fmt.Errorf("token %v was revoked", r.ID)
+	}
+	return r.User, r.ID, nil
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+/*
+	Returns random bytes as hex.
+*/
+func randomHex(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+func (r *tokenRecord) info() protocol.TokenInfo {
+	return protocol.TokenInfo{ID: r.ID, User: r.User, Created: r.Created, Revoked: r.Revoked}
+}
+
+/*
+	Returns every token issued, oldest first.
+*/
+func (m *Server) tokenInfos() []protocol.TokenInfo {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	infos := []protocol.TokenInfo{}
+	for _, r := range m.tokens.tokens {
+		infos = append(infos, r.info())
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Created.Before(infos[j].Created) })
+	return infos
+}
+
+/*
+	Issues a new token to user. From then on Peers
+	must join with a token.
+*/
+func (m *Server) issueToken(user string) (protocol.AdminIssueReply, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	reply := protocol.AdminIssueReply{}
+	if !protocol.ValidName(user) || strings.ContainsAny(user, "/ ") {
+		return reply, fmt.Errorf("invalid user name %q", user)
+	}
+	id, err := randomHex(4)
+	if err != nil {
+		return reply, err
+	}
+	secret, err := randomHex(24)
+	if err != nil {
+		return reply, err
+	}
+	if _, taken := m.tokens.tokens[id]; taken {
+		return reply, fmt.Errorf("token ID %v already in use, try again", id)
+	}
+	token := id + "." + secret
+	r := &tokenRecord{ID: id, User: user, Hash: hashToken(token), Created: time.Now()}
+	m.tokens.tokens[id] = r
+	if err := m.tokens.save(); err != nil {
+		delete(m.tokens.tokens, id)
+		return reply, err
+	}
+	fmt.Printf("Issued token %v to %v\n", id, user)
+	reply.Info = r.info()
+	reply.Token = token
+	return reply, nil
+}
+
+/*
+	Revokes a token. Connections made with it are refused from
+	now on, and the Peers that joined with it are marked offline
+	until they join again with another token. Peers of the same
+	user joined with other tokens are left alone.
+*/
+func (m *Server) revokeToken(id string) (protocol.AdminRevokeReply, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	reply := protocol.AdminRevokeReply{}
+	r, ok := m.tokens.tokens[id]
+	if !ok {
+		return reply, fmt.Errorf("%v %v", protocol.UnknownToken, id)
+	}
+	if !r.Revoked {
+		r.Revoked = true
+		if err := m.tokens.save(); err != nil {
+			r.Revoked = false
+			return reply, err
+		}
+		fmt.Printf("Revoked token %v of %v\n", id, r.User)
+	}
+	for _, pi := range m.peers {
+		if pi.tokenID == r.ID && pi.isConnected {
+			pi.isConnected = false
+			reply.NumPeers++
+		}
+	}
+	reply.Info = r.info()
+	return reply, nil
+}
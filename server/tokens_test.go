@@ -0,0 +1,112 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/junvalentine/FileSharing/protocol"
+)
+
+func openTestTokens(t *testing.T, dir string, secret string) *Server {
+	t.Helper()
+	m := newServer()
+	if err := m.loadTokens(dir, secret); err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+func issue(t *testing.T, m *Server, user string) (string, string) {
+	t.Helper()
+	reply, err := m.issueToken(user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return reply.Token, reply.Info.ID
+}
+
+func TestAuthenticate(t *testing.T) {
+	dir := t.TempDir()
+	m := openTestTokens(t, dir, "")
+	if user, id, err := m.authenticate(""); err != nil || user != sharedUser || id != "" {
+		t.Errorf("without tokens: %q, %q, %v, want the tracker open", user, id, err)
+	}
+
+	alice, aliceID := issue(t, m, "alice")
+	bob, _ := issue(t, m, "bob")
+	revoked, revokedID := issue(t, m, "alice")
+	if _, err := m.revokeToken(revokedID); err != nil {
+		t.Fatal(err)
+	}
+	// Tokens are loaded again from tokens.json, with a secret.
+	m = openTestTokens(t, dir, "s3cret")
+
+	id, secret, _ := strings.Cut(alice, ".")
+	cases := []struct {
+		token string
+		user  string
+		id    string
+		ok    bool
+	}{
+		{alice, "alice", aliceID, true},
+		{bob, "bob", "", true},
+		{"s3cret", sharedUser, "", true},
+		{"", "", "", false},
+		{"s3cret2", "", "", false},
+		{revoked, "", "", false},
+		{id, "", "", false},
+		{id + ".", "", "", false},
+		{id + "." + secret + "x", "", "", false},
+		{"00000000." + secret, "", "", false},
+		{"." + secret, "", "", false},
+	}
+	for _, c := range cases {
+		user, tokenID, err := m.authenticate(c.token)
+		if (err == nil) != c.ok || user != c.user || (c.id != "" && tokenID != c.id) {
+			t.Errorf("authenticate(%q) = %q, %q, %v, want %q, ok %v", c.token, user, tokenID, err, c.user, c.ok)
+		}
+	}
+}
+
+func TestRevokeToken(t *testing.T) {
+	m := openTestTokens(t, t.TempDir(), "")
+	_, laptopID := issue(t, m, "alice")
+	_, desktopID := issue(t, m, "alice")
+	_, bobID := issue(t, m, "bob")
+
+	joined := map[string]string{"laptop": laptopID, "desktop": desktopID, "bob": bobID}
+	users := map[string]string{"laptop": "alice", "desktop": "alice", "bob": "bob"}
+	peers := map[string]int{}
+	for identity, tokenID := range joined {
+		request := protocol.ConnectRequest{Version: protocol.Version, Identity: identity, Port: "127.0.0.1:9000", User: users[identity], TokenID: tokenID}
+		reply := protocol.ConnectReply{}
+		if err := m.ConnectPeer(&request, &reply); err != nil {
+			t.Fatal(err)
+		}
+		peers[identity] = reply.PeerID
+	}
+
+	reply, err := m.revokeToken(laptopID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reply.NumPeers != 1 || !reply.Info.Revoked {
+		t.Errorf("revoking the laptop's token: %+v", reply)
+	}
+	for identity, online := range map[string]bool{"laptop": false, "desktop": true, "bob": true} {
+		if got := m.peers[peers[identity]].isConnected; got != online {
+			t.Errorf("%v online %v, want %v", identity, got, online)
+		}
+	}
+	if _, _, err := m.authenticate("x"); err == nil {
+		t.Errorf("authenticate accepted an invalid token")
+	}
+
+	// Revoking again is harmless, unknown tokens are reported.
+	if reply, err := m.revokeToken(laptopID); err != nil || reply.NumPeers != 0 {
+		t.Errorf("revoking twice: %+v, %v", reply, err)
+	}
+	if _, err := m.revokeToken("ffffffff"); err == nil || !strings.Contains(err.Error(), protocol.UnknownToken) {
+		t.Errorf("revoking an unknown token: %v", err)
+	}
+}